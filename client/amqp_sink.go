@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"go.opentelemetry.io/otel"
+	"pack.ag/amqp"
+)
+
+// mqConnection is the AMQP connection shared by every amqp sink. It is dialed
+// on first use and redialed after the connection or session is lost.
+type mqConnection struct {
+	dial func() (*amqp.Client, error)
+
+	mu      sync.Mutex
+	client  *amqp.Client
+	session *amqp.Session
+}
+
+func newMQConnection(dial func() (*amqp.Client, error)) *mqConnection {
+	return &mqConnection{dial: dial}
+}
+
+// Session returns the current session, connecting first if needed.
+func (c *mqConnection) Session() (*amqp.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != nil {
+		return c.session, nil
+	}
+	client, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	c.client, c.session = client, session
+	return session, nil
+}
+
+// reset drops the connection if broken is still the current session, so the
+// next call to Session dials again.
+func (c *mqConnection) reset(broken *amqp.Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != broken || c.client == nil {
+		return
+	}
+	c.client.Close()
+	c.client, c.session = nil, nil
+}
+
+// Close ends the session and then the connection. Sinks must close their
+// links first.
+func (c *mqConnection) Close(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return nil
+	}
+	sessionErr := c.session.Close(ctx)
+	err := c.client.Close()
+	c.client, c.session = nil, nil
+	if sessionErr != nil {
+		return sessionErr
+	}
+	return err
+}
+
+// serviceBusBatchFormat is the message format Azure Service Bus and Event Hubs
+// use for a batch: each Data section holds one complete encoded message.
+const serviceBusBatchFormat = 0x80013700
+
+// amqpSink sends each transaction to an AMQP target address and waits for
+// the broker to settle it. Send may be called concurrently; with batching
+// enabled concurrent sends are grouped into batches, sent as one transfer per
+// message or, for Service Bus, as a single batch transfer.
+type amqpSink struct {
+	name       string
+	address    string
+	ttl        time.Duration
+	codec      Codec
+	mq         *mqConnection
+	batch      *batcher
+	serviceBus bool
+
+	mu      sync.Mutex
+	session *amqp.Session
+	sender  *amqp.Sender
+}
+
+func newAMQPSink(c SinkConfig, codec Codec, mq *mqConnection) (*amqpSink, error) {
+	s := &amqpSink{name: c.Name, address: c.Address, ttl: c.TTL.Duration, codec: codec, mq: mq, serviceBus: c.Batch.Format == batchFormatServiceBus}
+	if _, err := s.link(); err != nil {
+		return nil, err
+	}
+	if c.Batch.MaxMessages > 1 {
+		s.batch = newBatcher(c.Batch, s.sendBatch)
+	}
+	return s, nil
+}
+
+// link returns the open sender, opening a new one if the last one failed.
+func (s *amqpSink) link() (*amqp.Sender, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sender != nil {
+		return s.sender, nil
+	}
+	session, err := s.mq.Session()
+	if err != nil {
+		return nil, err
+	}
+	sender, err := session.NewSender(
+		amqp.LinkTargetAddress(s.address),
+		//Have the broker settle every transfer so Send only returns once it is accepted
+		amqp.LinkSenderSettle(amqp.ModeUnsettled),
+	)
+	if err != nil {
+		s.mq.reset(session)
+		return nil, err
+	}
+	s.session, s.sender = session, sender
+	return sender, nil
+}
+
+func (s *amqpSink) Name() string { return s.name }
+
+func (s *amqpSink) Send(ctx context.Context, transaction *pb.SubscribeStreamResponse) error {
+	encoded, err := s.codec.Encode(transaction)
+	if err != nil {
+		return permanentError{err}
+	}
+	msg := newAMQPMessage(transaction, encoded, s.ttl)
+	//Consumers continue the trace from the traceparent application property
+	otel.GetTextMapPropagator().Inject(ctx, applicationProperties(msg.ApplicationProperties))
+	if s.batch != nil {
+		return s.batch.add(ctx, msg)
+	}
+	return s.send(ctx, msg)
+}
+
+// newAMQPMessage wraps the encoded transaction with the properties brokers
+// route on and consumers dedupe on, so neither has to parse the body. The
+// message id is the transaction id and the subject is its type. CloudEvents
+// binary mode attributes become cloudEvents: application properties.
+func newAMQPMessage(transaction *pb.SubscribeStreamResponse, encoded Encoded, ttl time.Duration) *amqp.Message {
+	msg := amqp.NewMessage(encoded.Body)
+
+	created, err := time.Parse(time.RFC3339, transaction.Timestamp)
+	if err != nil {
+		created = time.Now()
+	}
+	msg.Header = &amqp.MessageHeader{
+		Durable: true,
+		TTL:     ttl,
+	}
+	msg.Properties = &amqp.MessageProperties{
+		MessageID:    transaction.Id,
+		ContentType:  encoded.ContentType,
+		Subject:      transaction.Type,
+		CreationTime: created,
+	}
+	msg.ApplicationProperties = map[string]interface{}{
+		"venue_id":  transaction.VenueId,
+		"vendor_id": transaction.VendorId,
+		"action":    transaction.Action,
+	}
+	for k, v := range encoded.Attributes {
+		if k != "datacontenttype" {
+			msg.ApplicationProperties["cloudEvents:"+k] = v
+		}
+	}
+	return msg
+}
+
+// applicationProperties carries trace context in AMQP application
+// properties.
+type applicationProperties map[string]interface{}
+
+func (p applicationProperties) Get(key string) string {
+	v, _ := p[key].(string)
+	return v
+}
+
+func (p applicationProperties) Set(key, value string) { p[key] = value }
+
+func (p applicationProperties) Keys() []string {
+	keys := make([]string, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (s *amqpSink) send(ctx context.Context, msg *amqp.Message) error {
+	sender, err := s.link()
+	if err != nil {
+		return err
+	}
+
+	err = sender.Send(ctx, msg)
+	if err == nil {
+		return nil
+	}
+
+	//A rejected disposition comes back as an *amqp.Error and will not change on retry
+	var rejected *amqp.Error
+	if errors.As(err, &rejected) {
+		return permanentError{err}
+	}
+
+	//Anything else means the link is gone; reopen it on the next attempt
+	s.mu.Lock()
+	if s.sender == sender {
+		sender.Close(ctx)
+		s.sender = nil
+		if errors.Is(err, amqp.ErrSessionClosed) || errors.Is(err, amqp.ErrConnClosed) {
+			s.mq.reset(s.session)
+		}
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// sendBatch sends msgs as one transfer each, all in flight at once, or for
+// Service Bus as a single batch transfer. If the broker rejects that batch
+// each message is sent on its own so only the bad ones fail.
+func (s *amqpSink) sendBatch(ctx context.Context, msgs []*amqp.Message) []error {
+	if !s.serviceBus || len(msgs) == 1 {
+		return s.sendEach(ctx, msgs)
+	}
+	errs := make([]error, len(msgs))
+
+	batch := &amqp.Message{Format: serviceBusBatchFormat}
+	for _, m := range msgs {
+		data, err := m.MarshalBinary()
+		if err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+			return errs
+		}
+		batch.Data = append(batch.Data, data)
+	}
+
+	err := s.send(ctx, batch)
+	if isPermanent(err) {
+		return s.sendEach(ctx, msgs)
+	}
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// sendEach sends every message as its own transfer, without waiting for one
+// to be settled before sending the next.
+func (s *amqpSink) sendEach(ctx context.Context, msgs []*amqp.Message) []error {
+	errs := make([]error, len(msgs))
+	var wg sync.WaitGroup
+	for i, m := range msgs {
+		wg.Add(1)
+		go func(i int, m *amqp.Message) {
+			defer wg.Done()
+			errs[i] = s.send(ctx, m)
+		}(i, m)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (s *amqpSink) Close(ctx context.Context) error {
+	if s.batch != nil {
+		s.batch.close(ctx)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sender == nil {
+		return nil
+	}
+	return s.sender.Close(ctx)
+}
+
+// batcher groups messages from concurrent senders into batches of at most
+// MaxMessages messages and MaxBytes bytes, waiting at most MaxLinger for a
+// batch to fill. Each batch is sent on its own goroutine so the next one can
+// fill while the previous one waits to be settled.
+type batcher struct {
+	cfg  BatchConfig
+	send func(context.Context, []*amqp.Message) []error
+	in   chan *batchItem
+	done chan struct{}
+
+	// ctx bounds every batch, rather than the context of any one sender, so
+	// a sender that gives up does not fail the others' messages. close
+	// cancels it if the batches in flight take too long.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type batchItem struct {
+	ctx    context.Context
+	msg    *amqp.Message
+	size   int
+	result chan error
+}
+
+func newBatcher(cfg BatchConfig, send func(context.Context, []*amqp.Message) []error) *batcher {
+	b := &batcher{cfg: cfg.withDefaults(), send: send, in: make(chan *batchItem), done: make(chan struct{})}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	go b.run()
+	return b
+}
+
+func (b *batcher) add(ctx context.Context, msg *amqp.Message) error {
+	size := 0
+	for _, d := range msg.Data {
+		size += len(d)
+	}
+	item := &batchItem{ctx: ctx, msg: msg, size: size, result: make(chan error, 1)}
+	select {
+	case b.in <- item:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-item.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *batcher) run() {
+	var (
+		pending []*batchItem
+		size    int
+		linger  <-chan time.Time
+		flights sync.WaitGroup
+	)
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		batch := pending
+		pending, size, linger = nil, 0, nil
+		flights.Add(1)
+		go func() {
+			defer flights.Done()
+			//Leave out the messages whose senders have given up on them already
+			var items []*batchItem
+			var msgs []*amqp.Message
+			for _, item := range batch {
+				if item.ctx.Err() == nil {
+					items = append(items, item)
+					msgs = append(msgs, item.msg)
+				}
+			}
+			if len(msgs) == 0 {
+				return
+			}
+			for i, err := range b.send(b.ctx, msgs) {
+				items[i].result <- err
+			}
+		}()
+	}
+
+	for {
+		select {
+		case item, ok := <-b.in:
+			if !ok {
+				flush()
+				flights.Wait()
+				close(b.done)
+				return
+			}
+			if len(pending) > 0 && size+item.size > b.cfg.MaxBytes {
+				flush()
+			}
+			pending = append(pending, item)
+			size += item.size
+			if len(pending) == 1 {
+				linger = time.After(b.cfg.MaxLinger.Duration)
+			}
+			if len(pending) >= b.cfg.MaxMessages || size >= b.cfg.MaxBytes {
+				flush()
+			}
+		case <-linger:
+			flush()
+		}
+	}
+}
+
+// close flushes what is pending and waits for every batch to be settled, or
+// until ctx is done and then for the batches to be cancelled.
+func (b *batcher) close(ctx context.Context) {
+	close(b.in)
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		b.cancel()
+		<-b.done
+	}
+	b.cancel()
+}
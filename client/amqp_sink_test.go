@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ransdepm/go-grpc-test/config"
+	"pack.ag/amqp"
+)
+
+// batchOf is a batch config that flushes at n messages, or after an hour.
+func batchOf(n int) BatchConfig {
+	return BatchConfig{MaxMessages: n, MaxLinger: config.Duration{Duration: time.Hour}}
+}
+
+func TestBatcherResults(t *testing.T) {
+	tests := []struct {
+		name string
+		send func([]*amqp.Message) []error
+		want map[string]string // message body to the error it gets, "" for none
+	}{
+		{"all settled", func(msgs []*amqp.Message) []error {
+			return make([]error, len(msgs))
+		}, map[string]string{"a": "", "b": "", "c": ""}},
+		{"one rejected", func(msgs []*amqp.Message) []error {
+			errs := make([]error, len(msgs))
+			for i, m := range msgs {
+				if string(m.GetData()) == "b" {
+					errs[i] = permanentError{errors.New("rejected b")}
+				}
+			}
+			return errs
+		}, map[string]string{"a": "", "b": "rejected b", "c": ""}},
+		{"link lost", func(msgs []*amqp.Message) []error {
+			errs := make([]error, len(msgs))
+			for i := range errs {
+				errs[i] = amqp.ErrLinkClosed
+			}
+			return errs
+		}, map[string]string{"a": "link closed", "b": "link closed", "c": "link closed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var batches int
+			var mu sync.Mutex
+			b := newBatcher(batchOf(3), func(ctx context.Context, msgs []*amqp.Message) []error {
+				mu.Lock()
+				batches++
+				mu.Unlock()
+				return tt.send(msgs)
+			})
+			defer b.close(context.Background())
+
+			var wg sync.WaitGroup
+			got := make(map[string]error)
+			for body := range tt.want {
+				wg.Add(1)
+				go func(body string) {
+					defer wg.Done()
+					err := b.add(context.Background(), amqp.NewMessage([]byte(body)))
+					mu.Lock()
+					got[body] = err
+					mu.Unlock()
+				}(body)
+			}
+			wg.Wait()
+
+			if batches != 1 {
+				t.Fatalf("sent %d batches, want 1", batches)
+			}
+			for body, want := range tt.want {
+				err := got[body]
+				switch {
+				case want == "" && err != nil:
+					t.Errorf("%s: unexpected error %v", body, err)
+				case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+					t.Errorf("%s: error %v, want %q", body, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBatcherLeavesOutGivenUp(t *testing.T) {
+	sent := make(chan []string, 1)
+	b := newBatcher(batchOf(2), func(ctx context.Context, msgs []*amqp.Message) []error {
+		//The batch is bound to the batcher, not to the sender that gave up
+		if ctx.Err() != nil {
+			t.Errorf("batch context is done: %v", ctx.Err())
+		}
+		var bodies []string
+		for _, m := range msgs {
+			bodies = append(bodies, string(m.GetData()))
+		}
+		sent <- bodies
+		return make([]error, len(msgs))
+	})
+	defer b.close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gaveUp := make(chan error, 1)
+	go func() { gaveUp <- b.add(ctx, amqp.NewMessage([]byte("a"))) }()
+	//Let a join the pending batch before its sender gives up on it
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-gaveUp; err != context.Canceled {
+		t.Fatalf("given up send returned %v, want %v", err, context.Canceled)
+	}
+
+	if err := b.add(context.Background(), amqp.NewMessage([]byte("b"))); err != nil {
+		t.Fatalf("send after the other gave up: %v", err)
+	}
+	if got := <-sent; len(got) != 1 || got[0] != "b" {
+		t.Fatalf("batch sent %v, want [b]", got)
+	}
+}
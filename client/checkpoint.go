@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+)
+
+// Checkpoint is where a subscription resumes without loss. It is sent back to
+// the server on subscribe. ID is the last transaction every matching sink has
+// confirmed, in the order they arrived, and is not sent again. Timestamp is a
+// low-water mark rather than that transaction's timestamp, since the upstream
+// does not return orders in time order: the start of the poll window of the
+// earliest transaction still unconfirmed. What is sent again from there is
+// delivered again.
+type Checkpoint struct {
+	ID        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+}
+
+// loadCheckpoint reads the checkpoint file. A missing file is not an error,
+// it just means the client has never delivered anything.
+func loadCheckpoint(path string) (Checkpoint, error) {
+	var c Checkpoint
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+func saveCheckpoint(path string, c Checkpoint) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data through a temporary file so a crash mid-write
+// never leaves a truncated file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// The checkpoint is saved at most this often, or sooner once this many
+// transactions have settled since the last save. Writing it on every settle
+// would put an fsync in front of every transaction.
+const (
+	checkpointFlushInterval = time.Second
+	checkpointFlushEvery    = 1000
+)
+
+// tracker assigns every received transaction a sequence number and advances
+// the checkpoint only once that transaction and all before it are settled by
+// every sink they were routed to. The advanced checkpoint is saved in the
+// background; a crash before a save only means some transactions are
+// delivered again.
+//
+// Poll windows only move forward, so the earliest unsettled transaction has
+// the earliest window of those still pending. With none pending the mark is
+// the window of the last one received: the rest of that window may still be
+// on its way, stamped earlier than anything seen so far.
+type tracker struct {
+	path string
+
+	mu        sync.Mutex
+	next      uint64
+	committed uint64 // every sequence below this is settled
+	pending   map[uint64]*delivery
+	last      Checkpoint
+	unsaved   int // advances since the last save
+
+	// saveMu keeps saves in order, outside mu.
+	saveMu   sync.Mutex
+	flushNow chan struct{}
+}
+
+type delivery struct {
+	transaction *pb.SubscribeStreamResponse
+	window      string
+	remaining   int
+}
+
+func newTracker(path string, last Checkpoint) *tracker {
+	return &tracker{path: path, pending: make(map[uint64]*delivery), last: last, flushNow: make(chan struct{}, 1)}
+}
+
+// run saves the checkpoint on an interval, and early when many transactions
+// have settled, until ctx is done.
+func (t *tracker) run(ctx context.Context) {
+	ticker := time.NewTicker(checkpointFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.flushNow:
+		}
+		t.Flush()
+	}
+}
+
+// Flush saves the checkpoint if it has advanced since the last save.
+func (t *tracker) Flush() {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+	t.mu.Lock()
+	last, unsaved := t.last, t.unsaved
+	t.unsaved = 0
+	t.mu.Unlock()
+	if unsaved == 0 || t.path == "" {
+		return
+	}
+	if err := saveCheckpoint(t.path, last); err != nil {
+		logger.Error().Err(err).Str("path", t.path).Msg("Saving checkpoint")
+		//Try again on the next flush
+		t.mu.Lock()
+		t.unsaved += unsaved
+		t.mu.Unlock()
+	}
+}
+
+// begin registers a transaction that was routed to sinks sinks and returns
+// its sequence number. window is the start of the poll window it was read in;
+// without one, from an older server, its own timestamp stands in.
+func (t *tracker) begin(transaction *pb.SubscribeStreamResponse, window string, sinks int) uint64 {
+	if window == "" {
+		window = transaction.Timestamp
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seq := t.next
+	t.next++
+	t.pending[seq] = &delivery{transaction: transaction, window: window, remaining: sinks}
+	t.advance()
+	return seq
+}
+
+// settle records that one sink has confirmed the transaction.
+func (t *tracker) settle(seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d, ok := t.pending[seq]; ok {
+		d.remaining--
+	}
+	t.advance()
+}
+
+// Last returns the current checkpoint.
+func (t *tracker) Last() Checkpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last
+}
+
+func (t *tracker) advance() {
+	moved := false
+	for {
+		d, ok := t.pending[t.committed]
+		if !ok || d.remaining > 0 {
+			break
+		}
+		t.last = Checkpoint{ID: d.transaction.Id, Timestamp: d.window}
+		delete(t.pending, t.committed)
+		t.committed++
+		t.unsaved++
+		moved = true
+	}
+	if !moved {
+		return
+	}
+	if d, ok := t.pending[t.committed]; ok {
+		t.last.Timestamp = d.window
+	}
+	if t.unsaved >= checkpointFlushEvery {
+		select {
+		case t.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+)
+
+// received is a transaction read in the poll window starting at window and
+// routed to sinks sinks.
+type received struct {
+	id, timestamp, window string
+	sinks                 int
+}
+
+func TestTrackerCheckpoint(t *testing.T) {
+	start := Checkpoint{ID: "start", Timestamp: "2024-01-01T09:00:00Z"}
+
+	tests := []struct {
+		name     string
+		received []received
+		settle   []uint64 // sequence numbers, in the order their sinks confirm them
+		want     Checkpoint
+	}{
+		{"nothing settled", []received{
+			{"a", "2024-01-01T10:00:05Z", "2024-01-01T10:00:00Z", 1},
+		}, nil, start},
+		{"settled in order", []received{
+			{"a", "2024-01-01T10:00:05Z", "2024-01-01T10:00:00Z", 1},
+			{"b", "2024-01-01T10:00:12Z", "2024-01-01T10:00:10Z", 1},
+		}, []uint64{0, 1}, Checkpoint{ID: "b", Timestamp: "2024-01-01T10:00:10Z"}},
+		{"later one settled first", []received{
+			{"a", "2024-01-01T10:00:05Z", "2024-01-01T10:00:00Z", 1},
+			{"b", "2024-01-01T10:00:12Z", "2024-01-01T10:00:10Z", 1},
+		}, []uint64{1}, start},
+		{"later one settled first, then the earlier", []received{
+			{"a", "2024-01-01T10:00:05Z", "2024-01-01T10:00:00Z", 1},
+			{"b", "2024-01-01T10:00:12Z", "2024-01-01T10:00:10Z", 1},
+		}, []uint64{1, 0}, Checkpoint{ID: "b", Timestamp: "2024-01-01T10:00:10Z"}},
+		//The mark is the window of the earliest still unsettled, not that of the last settled
+		{"held back by the earliest unsettled", []received{
+			{"a", "2024-01-01T10:00:05Z", "2024-01-01T10:00:00Z", 1},
+			{"b", "2024-01-01T10:00:12Z", "2024-01-01T10:00:10Z", 1},
+			{"c", "2024-01-01T10:00:21Z", "2024-01-01T10:00:20Z", 1},
+		}, []uint64{0, 2}, Checkpoint{ID: "a", Timestamp: "2024-01-01T10:00:10Z"}},
+		//The upstream returns a window's orders out of time order
+		{"timestamps out of order within a window", []received{
+			{"a", "2024-01-01T10:00:08Z", "2024-01-01T10:00:00Z", 1},
+			{"b", "2024-01-01T10:00:02Z", "2024-01-01T10:00:00Z", 1},
+		}, []uint64{0, 1}, Checkpoint{ID: "b", Timestamp: "2024-01-01T10:00:00Z"}},
+		{"no window from an older server", []received{
+			{"a", "2024-01-01T10:00:05Z", "", 1},
+		}, []uint64{0}, Checkpoint{ID: "a", Timestamp: "2024-01-01T10:00:05Z"}},
+		{"waiting for the second sink", []received{
+			{"a", "2024-01-01T10:00:05Z", "2024-01-01T10:00:00Z", 2},
+		}, []uint64{0}, start},
+		{"confirmed by both sinks", []received{
+			{"a", "2024-01-01T10:00:05Z", "2024-01-01T10:00:00Z", 2},
+		}, []uint64{0, 0}, Checkpoint{ID: "a", Timestamp: "2024-01-01T10:00:00Z"}},
+		{"routed to no sink", []received{
+			{"a", "2024-01-01T10:00:05Z", "2024-01-01T10:00:00Z", 1},
+			{"b", "2024-01-01T10:00:12Z", "2024-01-01T10:00:10Z", 0},
+		}, []uint64{0}, Checkpoint{ID: "b", Timestamp: "2024-01-01T10:00:10Z"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTracker("", start)
+			for _, r := range tt.received {
+				tr.begin(&pb.SubscribeStreamResponse{Id: r.id, Timestamp: r.timestamp}, r.window, r.sinks)
+			}
+			for _, seq := range tt.settle {
+				tr.settle(seq)
+			}
+			if got := tr.Last(); got != tt.want {
+				t.Fatalf("checkpoint = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackerFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	tr := newTracker(path, Checkpoint{})
+
+	//Nothing has settled, so there is nothing to save
+	tr.Flush()
+	if c, err := loadCheckpoint(path); err != nil || c != (Checkpoint{}) {
+		t.Fatalf("checkpoint before any settle = %+v, %v; want none", c, err)
+	}
+
+	seq := tr.begin(&pb.SubscribeStreamResponse{Id: "a", Timestamp: "2024-01-01T10:00:05Z"}, "2024-01-01T10:00:00Z", 1)
+	tr.settle(seq)
+	tr.Flush()
+	c, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Checkpoint{ID: "a", Timestamp: "2024-01-01T10:00:00Z"}); c != want {
+		t.Fatalf("saved checkpoint = %+v, want %+v", c, want)
+	}
+}
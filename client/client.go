@@ -3,145 +3,272 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"io"
-	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	grpc_retry "github.com/grpc-ecosystem/go-grpc-middleware/retry"
-	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"pack.ag/amqp"
 
+	"github.com/ransdepm/go-grpc-test/logging"
 	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"github.com/ransdepm/go-grpc-test/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/grpclog"
 )
 
 var (
-	serverAddr = flag.String("server_addr", goDotEnvVariable("SERVER_HOST")+":"+goDotEnvVariable("PORT"), "The server address in the format of host:port")
+	redrive     = flag.Bool("redrive", false, "Send everything in the dead-letter queue back to its sink and exit")
+	replayStart = flag.String("replay_start", "", "Replay the orders created since this RFC3339 time to the sinks and exit, leaving the checkpoint as it is")
+	replayEnd   = flag.String("replay_end", "", "With -replay_start, the RFC3339 time to replay until (default now)")
 )
 
-func HandleTransactions(client pb.PubsubClient, mq_session *amqp.Session) {
+// HandleTransactions subscribes once and dispatches every transaction to the
+// router until the stream ends. resume is advanced as transactions arrive so
+// the next subscription picks up after the last one received, from the start
+// of its poll window: the rest of that window may be stamped earlier.
+func HandleTransactions(ctx context.Context, client pb.PubsubClient, router *Router, resume *Checkpoint) (err error) {
 	in := &pb.SubscribeRequest{
-		TopicName: "orders",
+		TopicName:     "orders",
+		ResumeAfterId: resume.ID,
 	}
-
-	//Create gRPC stream connection with server
-	stream, err := client.Subscribe(context.Background(), in)
-	if err != nil {
-		log.Fatalf("%v.Subscribe(_) = _, %v", client, err)
+	if _, err := time.Parse(time.RFC3339, resume.Timestamp); err == nil {
+		in.ResumeFrom = resume.Timestamp
+		logger.Info().Str("resume_after_id", resume.ID).Str("resume_from", resume.Timestamp).Msg("Resuming")
+	} else if resume.Timestamp != "" {
+		logger.Warn().Str("resume_from", resume.Timestamp).Msg("Checkpoint timestamp is not RFC3339, starting from the latest window")
 	}
 
-	//Create MQ send connection to populate MQ
-	sender, err := mq_session.NewSender(
-		amqp.LinkTargetAddress(goDotEnvVariable("MQ_QUEUE")),
-	)
+	//The subscription is one span; each transaction received continues the trace of the poll that produced it
+	ctx, span := tracer.Start(ctx, "subscribe", trace.WithAttributes(attribute.String("resume.after_id", resume.ID)))
+	defer func() { tracing.End(span, err) }()
+
+	//Create gRPC stream connection with server
+	stream, err := client.Subscribe(ctx, in)
 	if err != nil {
-		log.Fatal("Creating sender link:", err)
+		return err
 	}
-	ctx := context.Background()
+	streamState.Set("subscribed")
 
 	for {
 		transaction, err := stream.Recv()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			log.Fatalf("%v.Subscribe(_) = _, %v", client, err)
+			return err
+		}
+		if transaction.Type == "control" {
+			if transaction.Action == "going_away" {
+				logger.Info().Msg("Server is shutting down, resubscribing")
+				return nil
+			}
+			if transaction.Action == "reauthenticate" {
+				logger.Info().Msg("Token expired, resubscribing with a new one")
+				return nil
+			}
+			continue
+		}
+		//The trace context and window are for us, not for the sinks' consumers
+		received, span := tracer.Start(tracing.Extract(ctx, transaction.TraceContext), "receive order",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithLinks(trace.LinkFromContext(ctx)),
+			trace.WithAttributes(attribute.String("order.id", transaction.Id)))
+		window := transaction.WindowStart
+		if window == "" {
+			window = transaction.Timestamp
 		}
-		//Add transaction to MQ.  For now print it out.
-		log.Println(prettyPrint(transaction))
+		transaction.TraceContext, transaction.WindowStart = nil, ""
+		perOrder.Debug().
+			Str("event_id", transaction.Id).
+			Str("event_type", transaction.Type).
+			Str("event_action", transaction.Action).
+			Str("event_timestamp", transaction.Timestamp).
+			Int64("venue_id", transaction.VenueId).
+			Int64("vendor_id", transaction.VendorId).
+			Msg("Received transaction")
+		messagesReceived.Inc()
 
-		// Send message
-		err = sender.Send(ctx, amqp.NewMessage(jsonByteArray(transaction)))
+		//Hand the transaction to every sink whose routing rule matches it
+		err = router.Dispatch(received, transaction, window)
+		span.End()
 		if err != nil {
-			log.Fatal("Sending message:", err)
+			return err
 		}
+		*resume = Checkpoint{ID: transaction.Id, Timestamp: window}
 	}
-
-	sender.Close(ctx)
 }
 
 func main() {
-	flag.Parse()
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Loading config")
+	}
+	if *replayEnd != "" && *replayStart == "" {
+		logger.Fatal().Msg("-replay_end needs -replay_start")
+	}
+	logger = logging.New("grpc-client", cfg.LogFormat)
+	perOrder = logging.Sampled(logger)
+	logging.SetLevel(cfg.LogLevel)
+	grpclog.SetLoggerV2(logging.GRPCLogger(logger))
+
+	flushSpans, err := tracing.Setup("grpc-client", cfg.TraceExporter)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Setting up tracing")
+	}
+
+	//SIGINT/SIGTERM stop the subscription and start draining. A second signal kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	checkpoint, err := loadCheckpoint(cfg.CheckpointFile)
+	if err != nil {
+		logger.Fatal().Err(err).Str("path", cfg.CheckpointFile).Msg("Loading checkpoint")
+	}
+
+	//The MQ connection is only opened when an amqp sink needs it
+	mq := newMQConnection(func() (*amqp.Client, error) {
+		return amqp.Dial(cfg.MQ.Instance,
+			amqp.ConnSASLPlain(cfg.MQ.Username, cfg.MQ.Password),
+		)
+	})
+
+	var sinks []Sink
+	for _, c := range cfg.Sinks {
+		sink, err := newSink(c, mq)
+		if err != nil {
+			logger.Fatal().Err(err).Str("sink", c.Name).Msg("Creating sink")
+		}
+		sinks = append(sinks, sink)
+	}
+
+	var deadLetters deadLetterQueue
+	if cfg.DeadLetter != nil {
+		deadLetters = newDeadLetterQueue(cfg.DeadLetter, mq)
+	}
+
+	//A replay delivers past orders without moving the checkpoint of the live subscription
+	trackerPath := cfg.CheckpointFile
+	if *replayStart != "" {
+		trackerPath = ""
+	}
+	tracker := newTracker(trackerPath, checkpoint)
+	router := NewRouter(cfg.Sinks, sinks, tracker, deadLetters)
+
+	if *redrive {
+		n, err := router.Redrive(ctx)
+		logger.Info().Int("dead_letters", n).Msg("Redrove dead letters")
+		shutdown(cfg.ShutdownTimeout.Duration, router, deadLetters, mq, nil)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Redriving dead letters")
+		}
+		return
+	}
 
 	//Create client connection
 	var opts []grpc.DialOption
 	opts = append(opts, grpc.WithInsecure())
 
-	//TBD: use JWT credentials when making connection
-	//grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")), grpc.WithPerRPCCredentials(jwtCreds))
+	//Present a JWT on every call when the server requires one. Issued tokens come
+	//from the server itself, over the same connection.
+	var creds *tokenCredentials
+	if cfg.Token != "" || cfg.ClientSecret != "" {
+		creds = &tokenCredentials{
+			token:    cfg.Token,
+			clientID: cfg.ClientID,
+			secret:   cfg.ClientSecret,
+			roles:    cfg.Roles,
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(creds))
+	}
 
-	//Add options for default interceptors that will allow for client retry 5 times when connections lost.
-	//TBD: Add more robust retry method
-	opts = append(opts, grpc.WithStreamInterceptor(grpc_retry.StreamClientInterceptor()))
-	opts = append(opts, grpc.WithUnaryInterceptor(grpc_retry.UnaryClientInterceptor()))
+	//Unary calls retry through the default interceptor. The subscription stream is
+	//kept alive by Supervise, which resumes after the last transaction received.
+	opts = append(opts, grpc.WithChainUnaryInterceptor(tracing.UnaryClientInterceptor(), grpc_retry.UnaryClientInterceptor()))
+	opts = append(opts, grpc.WithStreamInterceptor(tracing.StreamClientInterceptor()))
 
-	opts = append(opts, grpc.WithBlock())
-	log.Printf("Attempting to connect to %v", *serverAddr)
-	conn, err := grpc.Dial(*serverAddr, opts...)
+	//Dial without blocking so a server that is still starting is handled by the same backoff as a restart
+	logger.Info().Str("server_addr", cfg.ServerAddr).Msg("Connecting")
+	conn, err := grpc.Dial(cfg.ServerAddr, opts...)
 	if err != nil {
-		log.Fatalf("fail to dial: %v", err)
+		logger.Fatal().Err(err).Str("server_addr", cfg.ServerAddr).Msg("Dialing")
 	}
-	defer conn.Close()
 	client := pb.NewPubsubClient(conn)
+	if creds != nil {
+		creds.auth = pb.NewAuthClient(conn)
+	}
 
-	mq_client, err := amqp.Dial(goDotEnvVariable("MQ_INSTANCE"),
-		amqp.ConnSASLPlain(goDotEnvVariable("MQ_USERNAME"), goDotEnvVariable("MQ_PW")),
-	)
-	if err != nil {
-		log.Fatal("Dialing AMQP server:", err)
+	//Sinks get their own context so in-flight sends can finish after the subscription is cancelled
+	router.Start(context.Background())
+
+	if cfg.DebugAddr != "" {
+		go func() {
+			http.Handle("/metrics", promhttp.Handler())
+			logger.Info().Str("addr", cfg.DebugAddr).Msg("Serving debug vars at /debug/vars and metrics at /metrics")
+			logger.Error().Err(http.ListenAndServe(cfg.DebugAddr, nil)).Msg("Serving debug vars")
+		}()
 	}
-	defer mq_client.Close()
+	go watchConnState(ctx, conn)
 
-	mq_session, err := mq_client.NewSession()
-	if err != nil {
-		log.Fatal("Creating AMQP session:", err)
+	if *replayStart != "" {
+		n, err := Replay(ctx, client, router, *replayStart, *replayEnd)
+		stop()
+		shutdown(cfg.ShutdownTimeout.Duration, router, deadLetters, mq, conn)
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		flushSpans(flushCtx)
+		logger.Info().Int("orders", n).Msg("Replayed orders")
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Replaying")
+		}
+		return
 	}
 
-	HandleTransactions(client, mq_session)
-}
+	err = Supervise(ctx, client, router, checkpoint, cfg.ReconnectMinBackoff.Duration, cfg.ReconnectMaxBackoff.Duration)
+	if ctx.Err() != nil {
+		logger.Info().Dur("timeout_ms", cfg.ShutdownTimeout.Duration).Msg("Shutting down, draining in-flight transactions")
+	}
+	stop()
 
-func CreateToken(userid uint64) (string, error) {
-	var err error
-	//Creating Access Token
-	atClaims := jwt.MapClaims{}
-	atClaims["authorized"] = true
-	atClaims["user_id"] = userid
-	atClaims["exp"] = time.Now().Add(time.Minute * 60).Unix()
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
-	token, err := at.SignedString([]byte(goDotEnvVariable("ACCESS_SECRET")))
+	shutdown(cfg.ShutdownTimeout.Duration, router, deadLetters, mq, conn)
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := flushSpans(flushCtx); err != nil {
+		logger.Warn().Err(err).Msg("Flushing spans")
+	}
+	last := tracker.Last()
+	logger.Info().Str("event_id", last.ID).Str("event_timestamp", last.Timestamp).Msg("Last transaction delivered")
 	if err != nil {
-		return "", err
+		logger.Fatal().Err(err).Msg("Subscription failed")
 	}
-	return token, nil
-}
-
-func prettyPrint(i interface{}) string {
-	s, _ := json.MarshalIndent(i, "", "\t")
-	var x = "--------------------------------------------------------------------------\n" +
-		string(s) +
-		"\n--------------------------------------------------------------------------\n"
-	return string(x)
 }
 
-func jsonByteArray(i interface{}) []byte {
-	s, _ := json.Marshal(i)
-	return []byte(string(s))
-}
-
-// use godot package to load/read the .env file and
-// return the value of the key
-func goDotEnvVariable(key string) string {
-
-	// load .env file
-	err := godotenv.Load(".env")
+// shutdown drains the sinks within timeout and then closes the AMQP links,
+// session and connection, and the gRPC connection, in that order. The
+// checkpoint is saved once the sinks have drained.
+func shutdown(timeout time.Duration, router *Router, deadLetters deadLetterQueue, mq *mqConnection, conn *grpc.ClientConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	if err != nil {
-		log.Fatalf("Error loading .env file")
+	if err := router.Close(ctx); err != nil {
+		logger.Error().Err(err).Msg("Closing sinks")
+	}
+	if deadLetters != nil {
+		if err := deadLetters.Close(ctx); err != nil {
+			logger.Error().Err(err).Msg("Closing dead-letter queue")
+		}
+	}
+	if err := mq.Close(ctx); err != nil {
+		logger.Error().Err(err).Msg("Closing AMQP connection")
+	}
+	if conn != nil {
+		conn.Close()
 	}
-
-	return os.Getenv(key)
 }
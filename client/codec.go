@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Encoded is a transaction ready for a sink: the body, its content type, and
+// for CloudEvents binary mode the event attributes the sink must carry in its
+// own headers or properties.
+type Encoded struct {
+	Body        []byte
+	ContentType string
+	Attributes  map[string]string
+}
+
+// Codec turns a transaction into the wire format a sink's consumers expect.
+type Codec interface {
+	Encode(transaction *pb.SubscribeStreamResponse) (Encoded, error)
+}
+
+// Encodings a sink may choose from. json is the original encoding/json output
+// and stays the default so existing consumers see no change.
+const (
+	encodingJSON                  = "json"
+	encodingProtoJSON             = "protojson"
+	encodingProto                 = "proto"
+	encodingCloudEventsStructured = "cloudevents-structured"
+	encodingCloudEventsBinary     = "cloudevents-binary"
+)
+
+const defaultCloudEventsSource = "go-grpc-test/pubsub"
+
+// newCodec returns the codec for an encoding name. source is the CloudEvents
+// source attribute and is ignored by the other encodings. With a transform
+// the transformed document replaces the json body or the CloudEvents data;
+// the protobuf encodings cannot carry a reshaped document.
+func newCodec(encoding, source string, transform *Transformer) (Codec, error) {
+	if source == "" {
+		source = defaultCloudEventsSource
+	}
+	data := func(transaction *pb.SubscribeStreamResponse) ([]byte, error) {
+		return protojson.Marshal(transaction)
+	}
+	if transform != nil {
+		data = transform.Apply
+	}
+
+	switch encoding {
+	case "", encodingJSON:
+		if transform != nil {
+			return transformCodec{transform}, nil
+		}
+		return jsonCodec{}, nil
+	case encodingProtoJSON, encodingProto:
+		if transform != nil {
+			return nil, fmt.Errorf("the %s encoding cannot be combined with a transform", encoding)
+		}
+		if encoding == encodingProto {
+			return protoCodec{}, nil
+		}
+		return protoJSONCodec{}, nil
+	case encodingCloudEventsStructured:
+		return cloudEventsCodec{source: source, data: data, structured: true}, nil
+	case encodingCloudEventsBinary:
+		return cloudEventsCodec{source: source, data: data}, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(transaction *pb.SubscribeStreamResponse) (Encoded, error) {
+	body, err := json.Marshal(transaction)
+	return Encoded{Body: body, ContentType: "application/json"}, err
+}
+
+// transformCodec sends the transformed document as the json body.
+type transformCodec struct {
+	transform *Transformer
+}
+
+func (c transformCodec) Encode(transaction *pb.SubscribeStreamResponse) (Encoded, error) {
+	body, err := c.transform.Apply(transaction)
+	return Encoded{Body: body, ContentType: "application/json"}, err
+}
+
+type protoJSONCodec struct{}
+
+func (protoJSONCodec) Encode(transaction *pb.SubscribeStreamResponse) (Encoded, error) {
+	body, err := protojson.Marshal(transaction)
+	return Encoded{Body: body, ContentType: "application/json"}, err
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Encode(transaction *pb.SubscribeStreamResponse) (Encoded, error) {
+	body, err := proto.Marshal(transaction)
+	return Encoded{Body: body, ContentType: "application/x-protobuf"}, err
+}
+
+// cloudEventsCodec encodes CloudEvents 1.0 with the transaction in protojson,
+// or transformed, as the event data. In structured mode the whole event is
+// the body; in binary mode the body is just the data and the attributes
+// travel alongside.
+type cloudEventsCodec struct {
+	source     string
+	data       func(*pb.SubscribeStreamResponse) ([]byte, error)
+	structured bool
+}
+
+func (c cloudEventsCodec) Encode(transaction *pb.SubscribeStreamResponse) (Encoded, error) {
+	data, err := c.data(transaction)
+	if err != nil {
+		return Encoded{}, err
+	}
+
+	attributes := map[string]string{
+		"specversion":     "1.0",
+		"id":              transaction.Id,
+		"source":          c.source,
+		"type":            "pubsub." + transaction.Type + "." + transaction.Action,
+		"datacontenttype": "application/json",
+	}
+	if t, err := time.Parse(time.RFC3339, transaction.Timestamp); err == nil {
+		attributes["time"] = t.UTC().Format(time.RFC3339Nano)
+	}
+
+	if !c.structured {
+		return Encoded{Body: data, ContentType: "application/json", Attributes: attributes}, nil
+	}
+
+	event := make(map[string]interface{}, len(attributes)+1)
+	for k, v := range attributes {
+		event[k] = v
+	}
+	event["data"] = json.RawMessage(data)
+	body, err := json.Marshal(event)
+	return Encoded{Body: body, ContentType: "application/cloudevents+json"}, err
+}
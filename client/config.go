@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ransdepm/go-grpc-test/config"
+	"github.com/ransdepm/go-grpc-test/logging"
+	"github.com/ransdepm/go-grpc-test/tracing"
+)
+
+// Config is everything the client reads at startup. See package config for
+// where each setting can come from. The sinks and dead-letter destination can
+// be given in the config file itself or, as before, in a separate
+// -sinks_config file.
+type Config struct {
+	// ServerAddr is host:port. Without it the client dials ServerHost:Port.
+	ServerAddr string `json:"server_addr" env:"SERVER_ADDR" flag:"server_addr" usage:"The server address in the format of host:port (default SERVER_HOST:PORT)"`
+	ServerHost string `json:"server_host" env:"SERVER_HOST"`
+	Port       int    `json:"port" env:"PORT"`
+
+	MQ MQConfig `json:"mq"`
+
+	RoutingConfig
+	SinksConfig string `json:"sinks_config" env:"SINKS_CONFIG" flag:"sinks_config" usage:"A YAML or JSON file listing the sinks to forward transactions to and their routing rules"`
+
+	CheckpointFile      string          `json:"checkpoint_file" env:"CHECKPOINT_FILE" flag:"checkpoint_file" usage:"Where the client records the last transaction every sink has confirmed"`
+	ReconnectMinBackoff config.Duration `json:"reconnect_min_backoff" env:"RECONNECT_MIN_BACKOFF" flag:"reconnect_min_backoff" usage:"The first wait before resubscribing after the stream ends"`
+	ReconnectMaxBackoff config.Duration `json:"reconnect_max_backoff" env:"RECONNECT_MAX_BACKOFF" flag:"reconnect_max_backoff" usage:"The longest wait between resubscribe attempts"`
+	ShutdownTimeout     config.Duration `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown_timeout" usage:"How long to wait for in-flight transactions to be confirmed on shutdown"`
+	LogLevel            string          `json:"log_level" env:"LOG_LEVEL" flag:"log_level" usage:"debug, info, warn or error"`
+	LogFormat           string          `json:"log_format" env:"LOG_FORMAT" flag:"log_format" usage:"json, or console for reading logs in a terminal"`
+	TraceExporter       string          `json:"trace_exporter" env:"TRACE_EXPORTER" flag:"trace_exporter" usage:"Where to send OpenTelemetry spans: none or stdout"`
+	DebugAddr           string          `json:"debug_addr" env:"DEBUG_ADDR" flag:"debug_addr" usage:"If set, serve stream and connection state at http://<debug_addr>/debug/vars and Prometheus metrics at /metrics"`
+
+	// Token is a JWT issued for this client, sent with every call. Without
+	// it, and with ClientSecret, the client asks the server's Auth service
+	// for short-lived tokens as ClientID.
+	Token        string   `json:"token" env:"TOKEN"`
+	ClientID     string   `json:"client_id" env:"CLIENT_ID" flag:"client_id" usage:"Who the client is to the server"`
+	ClientSecret string   `json:"client_secret" env:"CLIENT_SECRET"`
+	Roles        []string `json:"roles,omitempty"`
+}
+
+// MQConfig is the AMQP broker shared by amqp sinks and dead letters. Queue is
+// the address of the default sink used when no sinks are configured.
+type MQConfig struct {
+	Instance string `json:"instance" env:"MQ_INSTANCE"`
+	Username string `json:"username" env:"MQ_USERNAME"`
+	Password string `json:"password" env:"MQ_PW"`
+	Queue    string `json:"queue" env:"MQ_QUEUE"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ServerHost:          "localhost",
+		ClientID:            "grpc-client",
+		Port:                50005,
+		CheckpointFile:      "client.checkpoint.json",
+		ReconnectMinBackoff: config.Duration{Duration: time.Second},
+		ReconnectMaxBackoff: config.Duration{Duration: time.Minute},
+		ShutdownTimeout:     config.Duration{Duration: 30 * time.Second},
+		LogLevel:            "info",
+		LogFormat:           logging.FormatJSON,
+		TraceExporter:       tracing.ExporterNone,
+	}
+}
+
+// loadConfig reads and validates the client config.
+func loadConfig() (*Config, error) {
+	c := defaultConfig()
+	if err := config.Load(c, flag.CommandLine, os.Args[1:]); err != nil {
+		return nil, err
+	}
+	if c.SinksConfig != "" {
+		var routing RoutingConfig
+		if err := config.ReadFile(c.SinksConfig, &routing); err != nil {
+			return nil, err
+		}
+		c.RoutingConfig = routing
+	}
+
+	if c.ServerAddr == "" {
+		c.ServerAddr = net.JoinHostPort(c.ServerHost, strconv.Itoa(c.Port))
+	}
+	//Without sinks the client keeps its original behaviour of forwarding everything to MQ_QUEUE
+	if len(c.Sinks) == 0 && c.MQ.Queue != "" {
+		c.Sinks = []SinkConfig{{Name: "mq", Type: "amqp", Address: c.MQ.Queue, WhenFull: "block"}}
+	}
+	return c, c.Validate()
+}
+
+// Validate reports every problem with the config at once.
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if _, port, err := net.SplitHostPort(c.ServerAddr); err != nil || port == "" {
+		errs.Addf("server_addr (SERVER_ADDR, -server_addr, or SERVER_HOST and PORT) must be host:port, got %q", c.ServerAddr)
+	}
+
+	if len(c.Sinks) == 0 {
+		errs.Addf("no sinks are configured: list them in the config file or -sinks_config, or set MQ_QUEUE to forward everything to one AMQP queue")
+	}
+	c.RoutingConfig.validate(&errs)
+	usesMQ := c.DeadLetter != nil && c.DeadLetter.Type == "amqp"
+	for _, s := range c.Sinks {
+		usesMQ = usesMQ || s.Type == "amqp"
+	}
+	if usesMQ && c.MQ.Instance == "" {
+		errs.Addf("mq.instance (MQ_INSTANCE) is required by amqp sinks and dead letters")
+	}
+
+	if c.CheckpointFile == "" {
+		errs.Addf("checkpoint_file (CHECKPOINT_FILE, -checkpoint_file) is required")
+	}
+	if c.ReconnectMinBackoff.Duration <= 0 {
+		errs.Addf("reconnect_min_backoff must be positive, got %v", c.ReconnectMinBackoff)
+	}
+	if c.ReconnectMaxBackoff.Duration < c.ReconnectMinBackoff.Duration {
+		errs.Addf("reconnect_max_backoff (%v) must not be shorter than reconnect_min_backoff (%v)", c.ReconnectMaxBackoff, c.ReconnectMinBackoff)
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		errs.Addf("shutdown_timeout must be positive, got %v", c.ShutdownTimeout)
+	}
+	if !logging.ValidLevel(c.LogLevel) {
+		errs.Addf("log_level (LOG_LEVEL, -log_level) must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	if !logging.ValidFormat(c.LogFormat) {
+		errs.Addf("log_format (LOG_FORMAT, -log_format) must be json or console, got %q", c.LogFormat)
+	}
+	if !tracing.ValidExporter(c.TraceExporter) {
+		errs.Addf("trace_exporter (TRACE_EXPORTER, -trace_exporter) must be none or stdout, got %q", c.TraceExporter)
+	}
+	return errs.Err()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"google.golang.org/grpc/credentials"
+)
+
+// tokenCredentials attaches a bearer JWT to every RPC. An issued token is
+// reused until shortly before it expires so each resubscribe carries a valid
+// one.
+type tokenCredentials struct {
+	token string // a token issued for this client, used as is
+
+	// Without a token, one is requested from the server's Auth service for
+	// clientID, authenticated by secret.
+	auth     pb.AuthClient
+	clientID string
+	secret   string
+	roles    []string
+
+	mu      sync.Mutex
+	issued  string
+	refresh time.Time
+}
+
+// authTokenMethod is called without credentials; it is how they are obtained.
+const authTokenMethod = "/pb_pubsub.Auth/Token"
+
+func (c *tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	if c.token != "" {
+		return map[string]string{"authorization": "Bearer " + c.token}, nil
+	}
+	if ri, ok := credentials.RequestInfoFromContext(ctx); ok && ri.Method == authTokenMethod {
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.issued == "" || time.Now().After(c.refresh) {
+		resp, err := c.auth.Token(ctx, &pb.TokenRequest{ClientId: c.clientID, ClientSecret: c.secret, Roles: c.roles})
+		if err != nil {
+			return nil, err
+		}
+		//Replace the token after four fifths of its lifetime
+		lifetime := time.Duration(resp.ExpiresIn) * time.Second
+		c.issued, c.refresh = resp.AccessToken, time.Now().Add(lifetime-lifetime/5)
+	}
+	return map[string]string{"authorization": "Bearer " + c.issued}, nil
+}
+
+// RequireTransportSecurity is false because the server is dialed without TLS.
+func (c *tokenCredentials) RequireTransportSecurity() bool { return false }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"pack.ag/amqp"
+)
+
+// DeadLetterConfig names where transactions go once a sink gives up on them.
+type DeadLetterConfig struct {
+	Type    string `json:"type"`              // amqp or file
+	Address string `json:"address,omitempty"` // amqp target address
+	Path    string `json:"path,omitempty"`    // file path
+}
+
+// DeadLetter is a transaction a sink could not deliver, with why and how
+// often it was tried.
+type DeadLetter struct {
+	Sink        string                      `json:"sink"`
+	Error       string                      `json:"error"`
+	Attempts    int                         `json:"attempts"`
+	FailedAt    string                      `json:"failed_at"`
+	Transaction *pb.SubscribeStreamResponse `json:"transaction"`
+}
+
+// deadLetterQueue stores dead letters and hands them back for redelivery.
+// Redrive calls send for each stored dead letter in order and stops at the
+// first failure, leaving it and everything after it queued.
+type deadLetterQueue interface {
+	Write(ctx context.Context, d DeadLetter) error
+	Redrive(ctx context.Context, send func(DeadLetter) error) (redriven int, err error)
+	Close(ctx context.Context) error
+}
+
+func (c *DeadLetterConfig) validate() error {
+	switch c.Type {
+	case "amqp":
+		if c.Address == "" {
+			return errors.New("address is required")
+		}
+	case "file":
+		if c.Path == "" {
+			return errors.New("path is required")
+		}
+	default:
+		return fmt.Errorf("type must be amqp or file, got %q", c.Type)
+	}
+	return nil
+}
+
+// newDeadLetterQueue builds the validated dead-letter destination c.
+func newDeadLetterQueue(c *DeadLetterConfig, mq *mqConnection) deadLetterQueue {
+	if c.Type == "amqp" {
+		return &amqpDeadLetters{address: c.Address, mq: mq}
+	}
+	return &fileDeadLetters{path: c.Path}
+}
+
+// fileDeadLetters keeps one JSON dead letter per line in a local file.
+type fileDeadLetters struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (q *fileDeadLetters) Write(ctx context.Context, d DeadLetter) error {
+	line, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	f, err := os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (q *fileDeadLetters) Redrive(ctx context.Context, send func(DeadLetter) error) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	data, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			lines = append(lines, append([]byte(nil), line...))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	redriven := 0
+	var sendErr error
+	for _, line := range lines {
+		var d DeadLetter
+		if err := json.Unmarshal(line, &d); err != nil {
+			sendErr = fmt.Errorf("line %d: %v", redriven+1, err)
+			break
+		}
+		if err := send(d); err != nil {
+			sendErr = err
+			break
+		}
+		redriven++
+	}
+
+	//Rewrite the file with whatever is still undelivered
+	var rest bytes.Buffer
+	for _, line := range lines[redriven:] {
+		rest.Write(line)
+		rest.WriteByte('\n')
+	}
+	if err := writeFileAtomic(q.path, rest.Bytes()); err != nil {
+		return redriven, err
+	}
+	return redriven, sendErr
+}
+
+func (q *fileDeadLetters) Close(ctx context.Context) error { return nil }
+
+// amqpDeadLetters sends dead letters to an AMQP address. The transaction is
+// the message body and the failure details are application properties. Each
+// dead letter gets its own message id; the transaction id is kept in the
+// transaction_id application property.
+type amqpDeadLetters struct {
+	address string
+	mq      *mqConnection
+
+	mu     sync.Mutex
+	sender *amqp.Sender
+}
+
+func (q *amqpDeadLetters) Write(ctx context.Context, d DeadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.sender == nil {
+		session, err := q.mq.Session()
+		if err != nil {
+			return err
+		}
+		q.sender, err = session.NewSender(
+			amqp.LinkTargetAddress(q.address),
+			amqp.LinkSenderSettle(amqp.ModeUnsettled),
+		)
+		if err != nil {
+			q.mq.reset(session)
+			return err
+		}
+	}
+
+	//Dead letters always use the json encoding so Redrive can read them back
+	encoded, err := jsonCodec{}.Encode(d.Transaction)
+	if err != nil {
+		return err
+	}
+	msg := newAMQPMessage(d.Transaction, encoded, 0)
+	//A transaction can be dead-lettered more than once, and a broker that
+	//dedupes on the message id would drop every copy after the first
+	id, err := deadLetterID()
+	if err != nil {
+		return err
+	}
+	msg.Properties.MessageID = id
+	msg.ApplicationProperties["transaction_id"] = d.Transaction.Id
+	msg.ApplicationProperties["dead_letter_sink"] = d.Sink
+	msg.ApplicationProperties["dead_letter_error"] = d.Error
+	msg.ApplicationProperties["dead_letter_attempts"] = int64(d.Attempts)
+	msg.ApplicationProperties["dead_letter_failed_at"] = d.FailedAt
+	if err := q.sender.Send(ctx, msg); err != nil {
+		q.sender.Close(ctx)
+		q.sender = nil
+		return err
+	}
+	return nil
+}
+
+// deadLetterID returns a random message id for a dead letter.
+func deadLetterID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// redriveIdle is how long Redrive waits for another message before deciding
+// the dead-letter address is empty.
+const redriveIdle = 5 * time.Second
+
+func (q *amqpDeadLetters) Redrive(ctx context.Context, send func(DeadLetter) error) (int, error) {
+	session, err := q.mq.Session()
+	if err != nil {
+		return 0, err
+	}
+	receiver, err := session.NewReceiver(amqp.LinkSourceAddress(q.address))
+	if err != nil {
+		return 0, err
+	}
+	defer receiver.Close(ctx)
+
+	redriven := 0
+	for {
+		recvCtx, cancel := context.WithTimeout(ctx, redriveIdle)
+		msg, err := receiver.Receive(recvCtx)
+		cancel()
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			return redriven, nil
+		}
+		if err != nil {
+			return redriven, err
+		}
+
+		d := DeadLetter{Transaction: &pb.SubscribeStreamResponse{}}
+		if err := json.Unmarshal(msg.GetData(), d.Transaction); err != nil {
+			msg.Release()
+			return redriven, fmt.Errorf("decoding dead letter: %v", err)
+		}
+		if d.Transaction.Id == "" {
+			d.Transaction.Id, _ = msg.ApplicationProperties["transaction_id"].(string)
+		}
+		d.Sink, _ = msg.ApplicationProperties["dead_letter_sink"].(string)
+		d.Error, _ = msg.ApplicationProperties["dead_letter_error"].(string)
+		d.FailedAt, _ = msg.ApplicationProperties["dead_letter_failed_at"].(string)
+		if attempts, ok := msg.ApplicationProperties["dead_letter_attempts"].(int64); ok {
+			d.Attempts = int(attempts)
+		}
+
+		if err := send(d); err != nil {
+			msg.Release()
+			return redriven, err
+		}
+		if err := msg.Accept(); err != nil {
+			return redriven, err
+		}
+		redriven++
+	}
+}
+
+func (q *amqpDeadLetters) Close(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.sender == nil {
+		return nil
+	}
+	return q.sender.Close(ctx)
+}
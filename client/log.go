@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/ransdepm/go-grpc-test/logging"
+)
+
+// logger writes the client's structured logs. It logs JSON from the start so
+// even a bad config is reported in a form the log pipeline can read, and is
+// replaced once the config has been loaded.
+var logger = logging.New("grpc-client", logging.FormatJSON)
+
+// perOrder logs events about single transactions, which are too many to keep
+// at debug level. It is derived from logger once the config is loaded.
+var perOrder = logging.Sampled(logger)
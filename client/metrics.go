@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"go.opentelemetry.io/otel"
+)
+
+// tracer starts the client's spans: the subscription, each transaction
+// received and each attempt to send it to a sink.
+var tracer = otel.Tracer("github.com/ransdepm/go-grpc-test/client")
+
+// Prometheus metrics, served with the debug vars at /metrics.
+var (
+	messagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "client_messages_received_total",
+		Help: "Transactions received from the server.",
+	})
+	reconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "client_stream_reconnects_total",
+		Help: "Times the subscription was opened again after it ended.",
+	})
+	sinkDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "client_sink_delivered_total",
+		Help: "Transactions a sink confirmed.",
+	}, []string{"sink"})
+	sinkSendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "client_sink_send_seconds",
+		Help:    "How long each send attempt took, by result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"sink", "result"})
+	sinkRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "client_sink_retries_total",
+		Help: "Send attempts repeated after a transient failure.",
+	}, []string{"sink"})
+	sinkDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "client_sink_dropped_total",
+		Help: "Transactions dropped because a when_full: drop sink's queue was full.",
+	}, []string{"sink"})
+	sinkDown = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "client_sink_down",
+		Help: "1 while a sink is down: it gave up on a transaction and has not accepted one since.",
+	}, []string{"sink"})
+	sinkHeld = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "client_sink_held",
+		Help: "Transactions held for a down sink without a dead-letter queue.",
+	}, []string{"sink"})
+	deadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "client_dead_lettered_total",
+		Help: "Transactions moved to the dead-letter queue after a sink gave up on them.",
+	}, []string{"sink"})
+	endToEndLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "client_end_to_end_lag_seconds",
+		Help:    "Time from a transaction's timestamp to a sink confirming it.",
+		Buckets: []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300, 600, 1800},
+	}, []string{"sink"})
+	lastDelivery = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "client_sink_last_delivery_timestamp_seconds",
+		Help: "When a sink last confirmed a transaction, in Unix seconds.",
+	}, []string{"sink"})
+)
+
+// observeDelivered records that sink confirmed transaction.
+func observeDelivered(sink string, transaction *pb.SubscribeStreamResponse) {
+	now := time.Now()
+	sinkDelivered.WithLabelValues(sink).Inc()
+	lastDelivery.WithLabelValues(sink).Set(float64(now.Unix()))
+	if created, err := time.Parse(time.RFC3339, transaction.Timestamp); err == nil {
+		endToEndLag.WithLabelValues(sink).Observe(now.Sub(created).Seconds())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"github.com/ransdepm/go-grpc-test/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Replay asks the server for the orders created between start and end and
+// dispatches each one to the router, as HandleTransactions does, until the
+// replay ends. It returns how many were received. A replay the server cuts
+// short ends with an error saying where to start the next one.
+func Replay(ctx context.Context, client pb.PubsubClient, router *Router, start, end string) (n int, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	//Stop reading from the server as soon as a sink gives up on a transaction
+	go func() {
+		select {
+		case <-router.Failed():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ctx, span := tracer.Start(ctx, "replay", trace.WithAttributes(attribute.String("replay.start", start), attribute.String("replay.end", end)))
+	defer func() { tracing.End(span, err) }()
+
+	stream, err := client.Replay(ctx, &pb.ReplayRequest{TopicName: "orders", Start: start, End: end})
+	if err != nil {
+		return 0, err
+	}
+	streamState.Set("replaying")
+	logger.Info().Str("start", start).Str("end", end).Msg("Replaying")
+
+	for {
+		transaction, err := stream.Recv()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			if routerErr := router.Err(); routerErr != nil {
+				return n, routerErr
+			}
+			return n, err
+		}
+		received, span := tracer.Start(tracing.Extract(ctx, transaction.TraceContext), "receive order",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithLinks(trace.LinkFromContext(ctx)),
+			trace.WithAttributes(attribute.String("order.id", transaction.Id), attribute.Bool("order.replayed", true)))
+		window := transaction.WindowStart
+		transaction.TraceContext, transaction.WindowStart = nil, ""
+		perOrder.Debug().
+			Str("event_id", transaction.Id).
+			Str("event_timestamp", transaction.Timestamp).
+			Msg("Received replayed transaction")
+		messagesReceived.Inc()
+
+		err = router.Dispatch(received, transaction, window)
+		span.End()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
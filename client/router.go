@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"github.com/ransdepm/go-grpc-test/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const defaultSinkBuffer = 100
+
+// Router fans transactions out to every sink whose rule matches them. Each
+// sink is fed by its own goroutine and queue so a slow or failing sink does
+// not hold up the others. A transaction only counts as delivered once every
+// sink it was routed to has confirmed it.
+type Router struct {
+	routes      []*route
+	tracker     *tracker
+	deadLetters deadLetterQueue
+	wg          sync.WaitGroup
+	cancel      context.CancelFunc
+
+	failOnce sync.Once
+	failed   chan struct{}
+	err      error
+}
+
+type route struct {
+	sink    Sink
+	match   map[string][]string
+	exclude map[string][]string
+	drop    bool
+	retry   RetryConfig
+	queue   chan queued
+
+	lanes        int
+	partitionKey string
+	broken       int32
+}
+
+type queued struct {
+	seq         uint64
+	transaction *pb.SubscribeStreamResponse
+	// span is where the transaction was received, the parent of its sends.
+	span trace.SpanContext
+}
+
+// NewRouter pairs each sink with the rule from its config. configs and sinks
+// must be in the same order. deadLetters may be nil.
+func NewRouter(configs []SinkConfig, sinks []Sink, tracker *tracker, deadLetters deadLetterQueue) *Router {
+	r := &Router{tracker: tracker, deadLetters: deadLetters, failed: make(chan struct{})}
+	for i, c := range configs {
+		buffer := c.Buffer
+		if buffer <= 0 {
+			buffer = defaultSinkBuffer
+		}
+		lanes := c.MaxInFlight
+		if lanes <= 0 {
+			lanes = 1
+		}
+		partitionKey := c.PartitionKey
+		if partitionKey == "" {
+			partitionKey = "id"
+		}
+		r.routes = append(r.routes, &route{
+			sink:         sinks[i],
+			match:        c.Match,
+			exclude:      c.Exclude,
+			drop:         c.WhenFull == "drop",
+			retry:        c.Retry.withDefaults(),
+			queue:        make(chan queued, buffer),
+			lanes:        lanes,
+			partitionKey: partitionKey,
+		})
+	}
+	return r
+}
+
+// Start launches one delivery goroutine per sink. Sends in progress are
+// cancelled when ctx is done or Close runs out of time.
+func (r *Router) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	go r.tracker.run(ctx)
+	for _, rt := range r.routes {
+		r.wg.Add(1)
+		go func(rt *route) {
+			defer r.wg.Done()
+			r.deliver(ctx, rt)
+		}(rt)
+	}
+}
+
+// deliver spreads the sink's queue over its lanes. Each lane sends one
+// transaction at a time, and every transaction with the same partition key
+// goes to the same lane, so per-key order holds even across retries.
+func (r *Router) deliver(ctx context.Context, rt *route) {
+	if rt.lanes == 1 {
+		r.deliverLane(ctx, rt, rt.queue)
+		return
+	}
+
+	var wg sync.WaitGroup
+	lanes := make([]chan queued, rt.lanes)
+	for i := range lanes {
+		lanes[i] = make(chan queued)
+		wg.Add(1)
+		go func(lane chan queued) {
+			defer wg.Done()
+			r.deliverLane(ctx, rt, lane)
+		}(lanes[i])
+	}
+	for q := range rt.queue {
+		key, _ := fieldValue(q.transaction, rt.partitionKey)
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		lanes[h.Sum32()%uint32(len(lanes))] <- q
+	}
+	for _, lane := range lanes {
+		close(lane)
+	}
+	wg.Wait()
+}
+
+// maxHeld is how many transactions a lane of a down sink holds without a
+// dead-letter queue before the router gives up on it.
+const maxHeld = 100000
+
+// deliverLane sends transactions in order, retrying transient failures. A
+// sink that gives up on a transaction is down: its lane keeps taking
+// transactions so it never holds up the other sinks, but only tries the sink
+// again once every max_backoff, with a single attempt. Until one succeeds,
+// transactions go to the dead-letter queue, or without one are held,
+// unsettled, and sent in order once the sink is back, one per turn of the
+// loop so the lane keeps reading while it catches up. If the dead-letter
+// queue fails too, or too many are held, the sink stops sending and the
+// router reports failure.
+func (r *Router) deliverLane(ctx context.Context, rt *route, lane <-chan queued) {
+	var held []queued
+	var probe <-chan time.Time  // set while the sink is down
+	var catchUp <-chan struct{} // ready while there is held work to send
+	probing := false            // the next send tests whether it is back
+	ready := make(chan struct{})
+	close(ready)
+	down := func(q queued, err error) {
+		if probe == nil && !probing {
+			logger.Warn().Err(err).Str("sink", rt.sink.Name()).Dur("probe_ms", rt.retry.MaxBackoff.Duration).Msg("Sink is down, sparing it until it recovers")
+			sinkDown.WithLabelValues(rt.sink.Name()).Set(1)
+		}
+		probing = false
+		probe = time.After(rt.retry.MaxBackoff.Duration)
+		r.spare(ctx, rt, &held, q, err)
+	}
+	//send sends q, with a single attempt while probing. Failures on shutdown
+	//leave the sink as it is.
+	send := func(q queued) {
+		attempts := rt.retry.MaxAttempts
+		if probing {
+			attempts = 1
+		}
+		if err := r.sendQueued(ctx, rt, q, attempts); err != nil {
+			if ctx.Err() == nil {
+				down(q, err)
+			}
+			return
+		}
+		if probing {
+			probing = false
+			r.recovered(rt)
+		}
+	}
+
+	for {
+		select {
+		case q, ok := <-lane:
+			if !ok {
+				//Anything still held stays unsettled and is delivered again after a restart
+				return
+			}
+			if atomic.LoadInt32(&rt.broken) != 0 || ctx.Err() != nil {
+				continue
+			}
+			//Behind a down sink or its held transactions, in order
+			if probe != nil || len(held) > 0 {
+				r.spare(ctx, rt, &held, q, nil)
+			} else {
+				send(q)
+			}
+		case <-probe:
+			probe = nil
+			probing = true
+		case <-catchUp:
+			q := held[0]
+			held = held[1:]
+			sinkHeld.WithLabelValues(rt.sink.Name()).Set(float64(len(held)))
+			send(q)
+		}
+		catchUp = nil
+		if probe == nil && len(held) > 0 && ctx.Err() == nil && atomic.LoadInt32(&rt.broken) == 0 {
+			catchUp = ready
+		}
+	}
+}
+
+// sendQueued sends q with up to attempts attempts and settles it. On
+// shutdown it is left unsettled, to be delivered again after a restart, and
+// the error is ctx's.
+func (r *Router) sendQueued(ctx context.Context, rt *route, q queued, attempts int) error {
+	n, err := rt.send(trace.ContextWithSpanContext(ctx, q.span), q.transaction, attempts)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return &sendError{attempts: n, err: fmt.Errorf("sink %s: sending %s: %v", rt.sink.Name(), q.transaction.Id, err)}
+	}
+	r.tracker.settle(q.seq)
+	return nil
+}
+
+// sendError is a transaction a sink gave up on.
+type sendError struct {
+	attempts int
+	err      error
+}
+
+func (e *sendError) Error() string { return e.err.Error() }
+
+// spare keeps q from a down sink: it is dead-lettered, or without a
+// dead-letter queue held. err is why it failed, or nil if it was not tried.
+func (r *Router) spare(ctx context.Context, rt *route, held *[]queued, q queued, err error) {
+	if r.deadLetters == nil {
+		if len(*held) >= maxHeld {
+			atomic.StoreInt32(&rt.broken, 1)
+			r.fail(fmt.Errorf("sink %s has been down for %d transactions and there is no dead_letter destination to move them to", rt.sink.Name(), maxHeld))
+			return
+		}
+		//Put it back in order: a failed probe or catch-up was the oldest
+		if err != nil {
+			*held = append([]queued{q}, *held...)
+		} else {
+			*held = append(*held, q)
+		}
+		sinkHeld.WithLabelValues(rt.sink.Name()).Set(float64(len(*held)))
+		return
+	}
+	attempts := 0
+	if se, ok := err.(*sendError); ok {
+		attempts = se.attempts
+	} else {
+		err = fmt.Errorf("sink %s is down, not sent", rt.sink.Name())
+	}
+	if dlqErr := r.deadLetter(ctx, rt, q.transaction, attempts, err); dlqErr != nil {
+		atomic.StoreInt32(&rt.broken, 1)
+		r.fail(dlqErr)
+		return
+	}
+	r.tracker.settle(q.seq)
+}
+
+// recovered notes that a down sink accepted a transaction again.
+func (r *Router) recovered(rt *route) {
+	logger.Info().Str("sink", rt.sink.Name()).Msg("Sink recovered")
+	sinkDown.WithLabelValues(rt.sink.Name()).Set(0)
+}
+
+func (r *Router) deadLetter(ctx context.Context, rt *route, transaction *pb.SubscribeStreamResponse, attempts int, sendErr error) error {
+	if r.deadLetters == nil {
+		return sendErr
+	}
+	err := r.deadLetters.Write(ctx, DeadLetter{
+		Sink:        rt.sink.Name(),
+		Error:       sendErr.Error(),
+		Attempts:    attempts,
+		FailedAt:    time.Now().UTC().Format(time.RFC3339),
+		Transaction: transaction,
+	})
+	if err != nil {
+		return fmt.Errorf("%v; writing dead letter: %v", sendErr, err)
+	}
+	logger.Warn().Err(sendErr).Str("sink", rt.sink.Name()).Str("event_id", transaction.Id).Int("attempts", attempts).Msg("Moved to the dead-letter queue")
+	deadLettered.WithLabelValues(rt.sink.Name()).Inc()
+	return nil
+}
+
+// send delivers one transaction in up to maxAttempts attempts, retrying
+// transient failures, and returns how many attempts it took. Every attempt is
+// a span continuing the trace in ctx.
+func (rt *route) send(ctx context.Context, transaction *pb.SubscribeStreamResponse, maxAttempts int) (int, error) {
+	backoff := rt.retry.InitialBackoff.Duration
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		sendCtx, span := tracer.Start(ctx, "send to "+rt.sink.Name(),
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(attribute.String("sink", rt.sink.Name()), attribute.String("order.id", transaction.Id), attribute.Int("attempt", attempt)))
+		err := rt.sink.Send(sendCtx, transaction)
+		tracing.End(span, err)
+		if err == nil {
+			sinkSendDuration.WithLabelValues(rt.sink.Name(), "ok").Observe(time.Since(start).Seconds())
+			observeDelivered(rt.sink.Name(), transaction)
+			return attempt, nil
+		}
+		sinkSendDuration.WithLabelValues(rt.sink.Name(), "error").Observe(time.Since(start).Seconds())
+		if isPermanent(err) || attempt >= maxAttempts {
+			return attempt, err
+		}
+		logger.Warn().Err(err).Str("sink", rt.sink.Name()).Str("event_id", transaction.Id).Int("attempt", attempt).Dur("backoff_ms", backoff).Msg("Send failed, retrying")
+		sinkRetries.WithLabelValues(rt.sink.Name()).Inc()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		}
+		backoff *= 2
+		if backoff > rt.retry.MaxBackoff.Duration {
+			backoff = rt.retry.MaxBackoff.Duration
+		}
+	}
+}
+
+func (r *Router) fail(err error) {
+	r.failOnce.Do(func() {
+		r.err = err
+		close(r.failed)
+	})
+}
+
+// Failed is closed when a sink gives up on a transaction. Err then returns
+// the reason.
+func (r *Router) Failed() <-chan struct{} { return r.failed }
+
+func (r *Router) Err() error {
+	select {
+	case <-r.failed:
+		return r.err
+	default:
+		return nil
+	}
+}
+
+// Dispatch queues transaction for every matching sink. Sinks configured to
+// drop when full lose the transaction rather than blocking the others; a
+// dropped transaction counts as settled for that sink. window is the start of
+// the poll window it was read in, for the checkpoint.
+func (r *Router) Dispatch(ctx context.Context, transaction *pb.SubscribeStreamResponse, window string) error {
+	var targets []*route
+	for _, rt := range r.routes {
+		if rt.accepts(transaction) {
+			targets = append(targets, rt)
+		}
+	}
+
+	seq := r.tracker.begin(transaction, window, len(targets))
+	for _, rt := range targets {
+		q := queued{seq: seq, transaction: transaction, span: trace.SpanContextFromContext(ctx)}
+		if rt.drop {
+			select {
+			case rt.queue <- q:
+			default:
+				perOrder.Warn().Str("sink", rt.sink.Name()).Str("event_id", transaction.Id).Msg("Queue full, dropping")
+				sinkDropped.WithLabelValues(rt.sink.Name()).Inc()
+				r.tracker.settle(seq)
+			}
+			continue
+		}
+		select {
+		case rt.queue <- q:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (r *Router) stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// Redrive sends every dead letter back to the sink that gave up on it. It
+// stops at the first dead letter that still cannot be delivered.
+func (r *Router) Redrive(ctx context.Context) (int, error) {
+	if r.deadLetters == nil {
+		return 0, errors.New("no dead_letter destination is configured")
+	}
+	routes := make(map[string]*route)
+	for _, rt := range r.routes {
+		routes[rt.sink.Name()] = rt
+	}
+	return r.deadLetters.Redrive(ctx, func(d DeadLetter) error {
+		rt, ok := routes[d.Sink]
+		if !ok {
+			return fmt.Errorf("dead letter %s is for unknown sink %q", d.Transaction.Id, d.Sink)
+		}
+		if _, err := rt.send(ctx, d.Transaction, rt.retry.MaxAttempts); err != nil {
+			return fmt.Errorf("sink %s: redriving %s: %v", d.Sink, d.Transaction.Id, err)
+		}
+		return nil
+	})
+}
+
+// Close waits for queued and in-flight transactions to be delivered and
+// closes the sinks. If ctx is done first the remaining sends are cancelled;
+// those transactions stay unsettled and the checkpoint stays before them.
+func (r *Router) Close(ctx context.Context) error {
+	for _, rt := range r.routes {
+		close(rt.queue)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		logger.Warn().Err(ctx.Err()).Msg("Gave up draining sinks")
+		r.stop()
+		<-drained
+	}
+	r.stop()
+	r.tracker.Flush()
+
+	var firstErr error
+	for _, rt := range r.routes {
+		if err := rt.sink.Close(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("closing sink %s: %v", rt.sink.Name(), err)
+		}
+	}
+	return firstErr
+}
+
+// accepts reports whether the transaction passes the route's rule. Every
+// field in match must equal one of its patterns and no field in exclude may.
+func (rt *route) accepts(transaction *pb.SubscribeStreamResponse) bool {
+	for field, patterns := range rt.match {
+		if !fieldMatches(transaction, field, patterns) {
+			return false
+		}
+	}
+	for field, patterns := range rt.exclude {
+		if fieldMatches(transaction, field, patterns) {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldMatches looks the field up by its proto or JSON name and compares its
+// value against shell-style patterns such as "sale" or "order*".
+func fieldMatches(transaction *pb.SubscribeStreamResponse, field string, patterns []string) bool {
+	value, ok := fieldValue(transaction, field)
+	if !ok {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldValue(transaction *pb.SubscribeStreamResponse, field string) (string, bool) {
+	fd := eventFieldDescriptor(field)
+	if fd == nil {
+		return "", false
+	}
+	return fmt.Sprint(transaction.ProtoReflect().Get(fd).Interface()), true
+}
+
+// checkRuleFields reports rule fields that transactions do not have, so typos
+// are caught at startup instead of silently matching nothing.
+func checkRuleFields(rule map[string][]string) error {
+	for field, patterns := range rule {
+		if !isEventField(field) {
+			return fmt.Errorf("unknown field %q", field)
+		}
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("field %q: bad pattern %q", field, p)
+			}
+		}
+	}
+	return nil
+}
+
+// isEventField reports whether transactions have a field with this proto or
+// JSON name.
+func isEventField(field string) bool {
+	return eventFieldDescriptor(field) != nil
+}
+
+func eventFieldDescriptor(field string) protoreflect.FieldDescriptor {
+	fields := (&pb.SubscribeStreamResponse{}).ProtoReflect().Descriptor().Fields()
+	fd := fields.ByName(protoreflect.Name(field))
+	if fd == nil {
+		fd = fields.ByJSONName(field)
+	}
+	if fd == nil || !isValueField(fd) {
+		return nil
+	}
+	return fd
+}
+
+// isValueField reports whether fd holds a single value of the order, rather
+// than delivery metadata: a map or list, or the window_start the client keeps
+// for its checkpoint.
+func isValueField(fd protoreflect.FieldDescriptor) bool {
+	return !fd.IsMap() && !fd.IsList() && fd.Message() == nil && fd.Name() != "window_start"
+}
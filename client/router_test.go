@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ransdepm/go-grpc-test/config"
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+)
+
+// fakeSink records what it was sent. fail decides whether the given attempt
+// at a transaction fails; nil means every send succeeds.
+type fakeSink struct {
+	name string
+	fail func(transaction *pb.SubscribeStreamResponse, attempt int) error
+
+	mu       sync.Mutex
+	attempts map[string]int
+	sent     []*pb.SubscribeStreamResponse
+}
+
+func (s *fakeSink) Name() string { return s.name }
+
+func (s *fakeSink) Send(ctx context.Context, transaction *pb.SubscribeStreamResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attempts == nil {
+		s.attempts = make(map[string]int)
+	}
+	s.attempts[transaction.Id]++
+	if s.fail != nil {
+		if err := s.fail(transaction, s.attempts[transaction.Id]); err != nil {
+			return err
+		}
+	}
+	s.sent = append(s.sent, transaction)
+	return nil
+}
+
+func (s *fakeSink) Close(ctx context.Context) error { return nil }
+
+// Attempts returns how often the transaction id was tried.
+func (s *fakeSink) Attempts(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[id]
+}
+
+// Sent returns the ids of the transactions delivered, in order.
+func (s *fakeSink) Sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, len(s.sent))
+	for i, transaction := range s.sent {
+		ids[i] = transaction.Id
+	}
+	return ids
+}
+
+// fakeDeadLetters keeps dead letters in memory.
+type fakeDeadLetters struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (q *fakeDeadLetters) Write(ctx context.Context, d DeadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.letters = append(q.letters, d)
+	return nil
+}
+
+func (q *fakeDeadLetters) Redrive(ctx context.Context, send func(DeadLetter) error) (int, error) {
+	return 0, errors.New("not supported")
+}
+
+func (q *fakeDeadLetters) Close(ctx context.Context) error { return nil }
+
+// fastRetry retries after a millisecond and probes a down sink every probe.
+func fastRetry(attempts int, probe time.Duration) RetryConfig {
+	return RetryConfig{
+		MaxAttempts:    attempts,
+		InitialBackoff: config.Duration{Duration: time.Millisecond},
+		MaxBackoff:     config.Duration{Duration: probe},
+	}
+}
+
+// transactions returns n transactions spread over venues venues.
+func transactions(n, venues int) []*pb.SubscribeStreamResponse {
+	out := make([]*pb.SubscribeStreamResponse, n)
+	for i := range out {
+		out[i] = &pb.SubscribeStreamResponse{
+			Id:        fmt.Sprintf("t%d", i),
+			VenueId:   int64(i % venues),
+			Timestamp: "2024-01-01T10:00:00Z",
+		}
+	}
+	return out
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRouterOrderAcrossRetries(t *testing.T) {
+	tests := []struct {
+		name  string
+		lanes int
+	}{
+		{"one lane", 1},
+		{"a lane per venue", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//Every other transaction fails twice before it goes through
+			sink := &fakeSink{name: "s", fail: func(transaction *pb.SubscribeStreamResponse, attempt int) error {
+				var i int
+				fmt.Sscanf(transaction.Id, "t%d", &i)
+				if i%2 == 0 && attempt <= 2 {
+					return errors.New("try again")
+				}
+				return nil
+			}}
+			configs := []SinkConfig{{Name: "s", Retry: fastRetry(5, 10*time.Millisecond), MaxInFlight: tt.lanes, PartitionKey: "venue_id"}}
+			tr := newTracker("", Checkpoint{})
+			r := NewRouter(configs, []Sink{sink}, tr, nil)
+			ctx := context.Background()
+			r.Start(ctx)
+
+			sent := transactions(40, 3)
+			for _, transaction := range sent {
+				if err := r.Dispatch(ctx, transaction, "2024-01-01T10:00:00Z"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := r.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			//Each venue's transactions arrive in the order they were dispatched
+			next := make(map[int64]int)
+			for _, id := range sink.Sent() {
+				var i int
+				fmt.Sscanf(id, "t%d", &i)
+				venue := sent[i].VenueId
+				if i < next[venue] {
+					t.Fatalf("%s arrived after a later transaction of venue %d; sent %v", id, venue, sink.Sent())
+				}
+				next[venue] = i
+			}
+			if got := len(sink.Sent()); got != len(sent) {
+				t.Fatalf("sent %d transactions, want %d", got, len(sent))
+			}
+			if got := tr.Last().ID; got != "t39" {
+				t.Fatalf("checkpoint id = %q, want t39", got)
+			}
+		})
+	}
+}
+
+func TestRouterDownSink(t *testing.T) {
+	down := func(*pb.SubscribeStreamResponse, int) error { return errors.New("connection refused") }
+
+	tests := []struct {
+		name        string
+		deadLetters *fakeDeadLetters
+		wantID      string // the checkpoint once the healthy sink has everything
+		wantLetters int
+	}{
+		//Held for the down sink, unsettled, so the checkpoint stays put
+		{"without dead letters", nil, "", 0},
+		{"with dead letters", &fakeDeadLetters{}, "t49", 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthy := &fakeSink{name: "healthy"}
+			broken := &fakeSink{name: "broken", fail: down}
+			//A buffer of one, so a blocked sink would soon block Dispatch
+			configs := []SinkConfig{
+				{Name: "healthy", Buffer: 1, Retry: fastRetry(1, time.Hour)},
+				{Name: "broken", Buffer: 1, Retry: fastRetry(1, time.Hour)},
+			}
+			tr := newTracker("", Checkpoint{})
+			var deadLetters deadLetterQueue
+			if tt.deadLetters != nil {
+				deadLetters = tt.deadLetters
+			}
+			r := NewRouter(configs, []Sink{healthy, broken}, tr, deadLetters)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			r.Start(ctx)
+
+			for _, transaction := range transactions(50, 1) {
+				if err := r.Dispatch(ctx, transaction, "2024-01-01T10:00:00Z"); err != nil {
+					t.Fatalf("dispatching %s: %v", transaction.Id, err)
+				}
+			}
+			waitFor(t, "the healthy sink", func() bool { return len(healthy.Sent()) == 50 })
+			if err := r.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Err(); err != nil {
+				t.Fatalf("router failed: %v", err)
+			}
+
+			if got := tr.Last().ID; got != tt.wantID {
+				t.Fatalf("checkpoint id = %q, want %q", got, tt.wantID)
+			}
+			if tt.deadLetters != nil && len(tt.deadLetters.letters) != tt.wantLetters {
+				t.Fatalf("dead letters = %d, want %d", len(tt.deadLetters.letters), tt.wantLetters)
+			}
+		})
+	}
+}
+
+func TestRouterRecoveredSinkCatchesUp(t *testing.T) {
+	var mu sync.Mutex
+	up := false
+	sink := &fakeSink{name: "s", fail: func(*pb.SubscribeStreamResponse, int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			return errors.New("connection refused")
+		}
+		return nil
+	}}
+	configs := []SinkConfig{{Name: "s", Retry: fastRetry(2, 10*time.Millisecond)}}
+	tr := newTracker("", Checkpoint{})
+	r := NewRouter(configs, []Sink{sink}, tr, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r.Start(ctx)
+
+	sent := transactions(20, 1)
+	for _, transaction := range sent[:10] {
+		if err := r.Dispatch(ctx, transaction, "2024-01-01T10:00:00Z"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the sink to go down", func() bool { return sink.Attempts("t0") >= 2 })
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	//Sent while it catches up, these go after the held ones
+	for _, transaction := range sent[10:] {
+		if err := r.Dispatch(ctx, transaction, "2024-01-01T10:00:00Z"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the sink to catch up", func() bool { return len(sink.Sent()) == len(sent) })
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, id := range sink.Sent() {
+		if want := sent[i].Id; id != want {
+			t.Fatalf("sent %v, want them in the order dispatched", sink.Sent())
+		}
+	}
+	if got := tr.Last().ID; got != "t19" {
+		t.Fatalf("checkpoint id = %q, want t19", got)
+	}
+}
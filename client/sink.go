@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ransdepm/go-grpc-test/config"
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Sink delivers transactions received from the server to a single destination.
+// Send must only return nil once the destination has accepted the transaction.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, transaction *pb.SubscribeStreamResponse) error
+	Close(ctx context.Context) error
+}
+
+// SinkConfig describes one destination the client forwards transactions to
+// and the rule deciding which transactions it receives.
+type SinkConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // amqp, file or webhook
+
+	Address string          `json:"address,omitempty"` // amqp target address
+	Path    string          `json:"path,omitempty"`    // file path
+	URL     string          `json:"url,omitempty"`     // webhook url
+	Timeout config.Duration `json:"timeout,omitempty"` // webhook request timeout
+
+	Match   map[string][]string `json:"match,omitempty"`
+	Exclude map[string][]string `json:"exclude,omitempty"`
+
+	// Buffer is the number of transactions queued for the sink before
+	// WhenFull applies. WhenFull is either "block" or "drop".
+	Buffer   int    `json:"buffer,omitempty"`
+	WhenFull string `json:"when_full,omitempty"`
+
+	Retry RetryConfig `json:"retry,omitempty"`
+
+	// MaxInFlight is how many transactions the sink may have waiting for
+	// confirmation at once (default 1). Transactions with the same value of
+	// the PartitionKey field (default "id") are always sent one at a time and
+	// in the order they were received.
+	MaxInFlight  int    `json:"max_in_flight,omitempty"`
+	PartitionKey string `json:"partition_key,omitempty"`
+
+	// Batch groups in-flight transactions into a single transfer. amqp only.
+	Batch BatchConfig `json:"batch,omitempty"`
+
+	// TTL is how long the broker keeps an undelivered message. amqp only.
+	TTL config.Duration `json:"ttl,omitempty"`
+
+	// Encoding is the wire format: json (default), protojson, proto,
+	// cloudevents-structured or cloudevents-binary. CloudEventsSource is the
+	// source attribute of CloudEvents encodings.
+	Encoding          string `json:"encoding,omitempty"`
+	CloudEventsSource string `json:"cloudevents_source,omitempty"`
+
+	// Transform reshapes the transaction before it is encoded.
+	Transform *TransformConfig `json:"transform,omitempty"`
+}
+
+// BatchConfig bounds a batch by message count and encoded size, and by how
+// long the first message waits for the batch to fill. A batch is sent as one
+// transfer per message, all in flight together, unless Format names a batch
+// message format the broker understands.
+type BatchConfig struct {
+	MaxMessages int             `json:"max_messages,omitempty"`
+	MaxBytes    int             `json:"max_bytes,omitempty"`
+	MaxLinger   config.Duration `json:"max_linger,omitempty"`
+	Format      string          `json:"format,omitempty"`
+}
+
+// batchFormatServiceBus sends a batch as a single transfer in the batch
+// message format of Azure Service Bus and Event Hubs. Other brokers do not
+// know it.
+const batchFormatServiceBus = "servicebus"
+
+func (c BatchConfig) withDefaults() BatchConfig {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 256 * 1024
+	}
+	if c.MaxLinger.Duration <= 0 {
+		c.MaxLinger.Duration = 50 * time.Millisecond
+	}
+	return c
+}
+
+// RetryConfig controls how often a sink retries a transient failure before
+// giving up on a transaction. The backoff doubles after every attempt.
+type RetryConfig struct {
+	MaxAttempts    int             `json:"max_attempts,omitempty"`
+	InitialBackoff config.Duration `json:"initial_backoff,omitempty"`
+	MaxBackoff     config.Duration `json:"max_backoff,omitempty"`
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+	if c.InitialBackoff.Duration <= 0 {
+		c.InitialBackoff.Duration = time.Second
+	}
+	if c.MaxBackoff.Duration <= 0 {
+		c.MaxBackoff.Duration = 30 * time.Second
+	}
+	if c.MaxBackoff.Duration < c.InitialBackoff.Duration {
+		c.MaxBackoff.Duration = c.InitialBackoff.Duration
+	}
+	return c
+}
+
+// permanentError marks a sink failure that retrying will not fix, such as a
+// message the broker rejected.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// RoutingConfig lists the sinks and where undeliverable transactions go.
+type RoutingConfig struct {
+	Sinks      []SinkConfig      `json:"sinks"`
+	DeadLetter *DeadLetterConfig `json:"dead_letter,omitempty"`
+}
+
+// validate checks the sinks and dead-letter destination, recording every
+// problem in errs.
+func (c *RoutingConfig) validate(errs *config.Errors) {
+	names := make(map[string]bool)
+	for i, sink := range c.Sinks {
+		if sink.Name == "" {
+			errs.Addf("sinks[%d]: name is required", i)
+			continue
+		}
+		if names[sink.Name] {
+			errs.Addf("sink %q is defined twice", sink.Name)
+		}
+		names[sink.Name] = true
+		if err := sink.validate(); err != nil {
+			errs.Addf("sink %q: %v", sink.Name, err)
+		}
+	}
+	if c.DeadLetter != nil {
+		if err := c.DeadLetter.validate(); err != nil {
+			errs.Addf("dead_letter: %v", err)
+		}
+	}
+}
+
+func (c SinkConfig) validate() error {
+	switch c.Type {
+	case "amqp":
+		if c.Address == "" {
+			return errors.New("address is required")
+		}
+	case "file":
+		if c.Path == "" {
+			return errors.New("path is required")
+		}
+	case "webhook":
+		if c.URL == "" {
+			return errors.New("url is required")
+		}
+	default:
+		return fmt.Errorf("type must be amqp, file or webhook, got %q", c.Type)
+	}
+	switch c.WhenFull {
+	case "", "block", "drop":
+	default:
+		return errors.New("when_full must be block or drop")
+	}
+	if err := checkRuleFields(c.Match); err != nil {
+		return fmt.Errorf("match: %v", err)
+	}
+	if err := checkRuleFields(c.Exclude); err != nil {
+		return fmt.Errorf("exclude: %v", err)
+	}
+	if c.PartitionKey != "" && !isEventField(c.PartitionKey) {
+		return fmt.Errorf("partition_key: unknown field %q", c.PartitionKey)
+	}
+	if c.Batch.MaxMessages > 1 && c.Type != "amqp" {
+		return errors.New("batch is only supported by amqp sinks")
+	}
+	if c.Batch.Format != "" && c.Batch.Format != batchFormatServiceBus {
+		return fmt.Errorf("batch: format must be %s or unset, got %q", batchFormatServiceBus, c.Batch.Format)
+	}
+	//A batch only holds in-flight transactions, so a smaller max_in_flight leaves every batch waiting out max_linger short
+	if inFlight := c.MaxInFlight; c.Batch.MaxMessages > 1 && inFlight < c.Batch.MaxMessages {
+		if inFlight <= 0 {
+			inFlight = 1
+		}
+		return fmt.Errorf("batch: max_in_flight must be at least max_messages (%d), got %d", c.Batch.MaxMessages, inFlight)
+	}
+	if _, err := c.codec(); err != nil {
+		return err
+	}
+	//A file has nowhere to put binary mode attributes and no framing for binary protobuf
+	if c.Type == "file" && (c.Encoding == encodingProto || c.Encoding == encodingCloudEventsBinary) {
+		return fmt.Errorf("file sinks do not support the %s encoding", c.Encoding)
+	}
+	return nil
+}
+
+// codec builds the sink's transform and encoding.
+func (c SinkConfig) codec() (Codec, error) {
+	var transform *Transformer
+	if c.Transform != nil {
+		var err error
+		if transform, err = newTransformer(c.Transform); err != nil {
+			return nil, fmt.Errorf("transform: %v", err)
+		}
+	}
+	return newCodec(c.Encoding, c.CloudEventsSource, transform)
+}
+
+// newSink builds the sink described by c, which has been validated. amqp
+// sinks share mq.
+func newSink(c SinkConfig, mq *mqConnection) (Sink, error) {
+	codec, err := c.codec()
+	if err != nil {
+		return nil, fmt.Errorf("sink %q: %v", c.Name, err)
+	}
+	switch c.Type {
+	case "amqp":
+		return newAMQPSink(c, codec, mq)
+	case "file":
+		return newFileSink(c.Name, c.Path, codec)
+	case "webhook":
+		return newWebhookSink(c.Name, c.URL, c.Timeout.Duration, codec), nil
+	default:
+		return nil, fmt.Errorf("sink %q: unknown type %q", c.Name, c.Type)
+	}
+}
+
+// fileSink appends one encoded transaction per line to a local file.
+type fileSink struct {
+	name  string
+	codec Codec
+	mu    sync.Mutex
+	f     *os.File
+}
+
+func newFileSink(name, path string, codec Codec) (*fileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{name: name, codec: codec, f: f}, nil
+}
+
+func (s *fileSink) Name() string { return s.name }
+
+func (s *fileSink) Send(ctx context.Context, transaction *pb.SubscribeStreamResponse) error {
+	encoded, err := s.codec.Encode(transaction)
+	if err != nil {
+		return permanentError{err}
+	}
+	line := append(encoded.Body, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(line); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileSink) Close(ctx context.Context) error {
+	return s.f.Close()
+}
+
+// webhookSink POSTs each encoded transaction to a URL. CloudEvents binary
+// mode attributes are sent as ce- headers.
+type webhookSink struct {
+	name   string
+	url    string
+	codec  Codec
+	client *http.Client
+}
+
+func newWebhookSink(name, url string, timeout time.Duration, codec Codec) *webhookSink {
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &webhookSink{name: name, url: url, codec: codec, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *webhookSink) Name() string { return s.name }
+
+func (s *webhookSink) Send(ctx context.Context, transaction *pb.SubscribeStreamResponse) error {
+	encoded, err := s.codec.Encode(transaction)
+	if err != nil {
+		return permanentError{err}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(encoded.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", encoded.ContentType)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	for k, v := range encoded.Attributes {
+		if k != "datacontenttype" {
+			req.Header.Set("ce-"+k, v)
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("webhook %s returned %s", s.url, resp.Status)
+		//Client errors will fail the same way again, except timeouts and throttling
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *webhookSink) Close(ctx context.Context) error {
+	s.client.CloseIdleConnections()
+	return nil
+}
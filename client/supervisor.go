@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"math/rand"
+	"time"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Stream and connection state, published on the debug endpoint.
+var (
+	streamState      = expvar.NewString("stream_state")
+	streamReconnects = expvar.NewInt("stream_reconnects")
+	connState        = expvar.NewString("grpc_conn_state")
+)
+
+// stableStream is how long a subscription must stay up, without receiving
+// anything, before the reconnect backoff starts again from the minimum.
+const stableStream = 30 * time.Second
+
+// Supervise keeps the subscription alive. Whenever the stream ends, because
+// of a network error or a server restart, it subscribes again with backoff,
+// resuming after the last transaction it received. It returns when ctx is
+// cancelled, a sink gives up on a transaction, or the server rejects the
+// subscription outright.
+func Supervise(ctx context.Context, client pb.PubsubClient, router *Router, resume Checkpoint, minBackoff, maxBackoff time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	//Stop reading from the server as soon as a sink gives up on a transaction
+	go func() {
+		select {
+		case <-router.Failed():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := minBackoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			streamReconnects.Add(1)
+			reconnects.Inc()
+		}
+		streamState.Set("subscribing")
+		started := time.Now()
+		last := resume
+
+		err := HandleTransactions(ctx, client, router, &resume)
+		if routerErr := router.Err(); routerErr != nil {
+			streamState.Set("failed")
+			return routerErr
+		}
+		if ctx.Err() != nil {
+			streamState.Set("stopped")
+			return nil
+		}
+		if err != nil && !retryableStreamError(err) {
+			streamState.Set("failed")
+			return err
+		}
+
+		if resume != last || time.Since(started) > stableStream {
+			backoff = minBackoff
+		}
+		wait := jitter(backoff)
+		streamState.Set("reconnecting")
+		if err == nil {
+			logger.Info().Dur("wait_ms", wait).Msg("Server closed the stream, resubscribing")
+		} else {
+			logger.Warn().Err(err).Dur("wait_ms", wait).Msg("Stream failed, resubscribing")
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			streamState.Set("stopped")
+			return router.Err()
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// retryableStreamError reports whether subscribing again could succeed.
+// Errors that describe the request itself will fail the same way every time.
+func retryableStreamError(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied, codes.Unimplemented:
+		return false
+	}
+	return true
+}
+
+// jitter spreads reconnects from many clients over [d/2, d).
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// watchConnState logs every change of the gRPC channel state until ctx is done.
+func watchConnState(ctx context.Context, conn *grpc.ClientConn) {
+	state := conn.GetState()
+	for {
+		connState.Set(state.String())
+		logger.Info().Str("target", conn.Target()).Str("state", state.String()).Msg("Connection state changed")
+		if !conn.WaitForStateChange(ctx, state) {
+			return
+		}
+		state = conn.GetState()
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+)
+
+// TransformConfig reshapes transactions for a sink's consumers, either with
+// field mappings or with a Go template that renders JSON. Set one or the
+// other, not both.
+type TransformConfig struct {
+	// Fields builds the output one mapping at a time. With KeepUnmapped,
+	// transaction fields no mapping reads from are copied over unchanged.
+	Fields       []FieldMapping `json:"fields,omitempty"`
+	KeepUnmapped bool           `json:"keep_unmapped,omitempty"`
+
+	// Template is a text/template executed with the transaction's fields by
+	// proto name, e.g. {{.venue_id}}. It must render a JSON document.
+	Template string `json:"template,omitempty"`
+}
+
+// FieldMapping writes one output field. To is a dot separated path such as
+// "order.id" so fields can be nested or flattened. The value is either the
+// transaction field named by From or the static Value.
+type FieldMapping struct {
+	To    string      `json:"to"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Transformer applies a validated TransformConfig.
+type Transformer struct {
+	fields       []FieldMapping
+	keepUnmapped bool
+	mapped       map[string]bool
+	template     *template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"now": func() string {
+		return time.Now().UTC().Format(time.RFC3339)
+	},
+	"default": func(def, v interface{}) interface{} {
+		if v == nil || v == "" || v == int64(0) {
+			return def
+		}
+		return v
+	},
+}
+
+// newTransformer checks the config and renders a sample transaction through
+// it so mistakes surface at startup rather than on the first order.
+func newTransformer(c *TransformConfig) (*Transformer, error) {
+	t := &Transformer{keepUnmapped: c.KeepUnmapped, mapped: make(map[string]bool)}
+	switch {
+	case c.Template != "" && len(c.Fields) > 0:
+		return nil, errors.New("set either fields or template, not both")
+	case c.Template != "":
+		tmpl, err := template.New("transform").Funcs(templateFuncs).Option("missingkey=error").Parse(c.Template)
+		if err != nil {
+			return nil, err
+		}
+		t.template = tmpl
+	case len(c.Fields) > 0:
+		for i, f := range c.Fields {
+			if f.To == "" {
+				return nil, fmt.Errorf("fields[%d]: to is required", i)
+			}
+			if (f.From == "") == (f.Value == nil) {
+				return nil, fmt.Errorf("fields[%d]: set exactly one of from or value", i)
+			}
+			if f.From != "" {
+				fd := eventFieldDescriptor(f.From)
+				if fd == nil {
+					return nil, fmt.Errorf("fields[%d]: unknown field %q", i, f.From)
+				}
+				//Mappings read by proto name whichever name the config used
+				f.From = string(fd.Name())
+				t.mapped[f.From] = true
+			}
+			t.fields = append(t.fields, f)
+		}
+	default:
+		return nil, errors.New("set fields or template")
+	}
+
+	sample := &pb.SubscribeStreamResponse{
+		Id:          "00000000-0000-0000-0000-000000000000",
+		Type:        "sale",
+		Action:      "order",
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		ResourceUrl: "https://example.com/orders/00000000-0000-0000-0000-000000000000",
+		VenueId:     1,
+		VendorId:    1,
+	}
+	if _, err := t.Apply(sample); err != nil {
+		return nil, fmt.Errorf("rendering a sample transaction: %v", err)
+	}
+	return t, nil
+}
+
+// Apply returns the transformed transaction as compact JSON.
+func (t *Transformer) Apply(transaction *pb.SubscribeStreamResponse) ([]byte, error) {
+	fields := transactionFields(transaction)
+
+	if t.template != nil {
+		var buf bytes.Buffer
+		if err := t.template.Execute(&buf, fields); err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		if err := json.Compact(&out, buf.Bytes()); err != nil {
+			return nil, fmt.Errorf("template did not render JSON: %v", err)
+		}
+		return out.Bytes(), nil
+	}
+
+	doc := make(map[string]interface{})
+	if t.keepUnmapped {
+		for name, v := range fields {
+			//Only replayed orders are marked, as they are without a transform
+			if t.mapped[name] || (name == "replayed" && v == false) {
+				continue
+			}
+			doc[name] = v
+		}
+	}
+	for _, f := range t.fields {
+		v := f.Value
+		if f.From != "" {
+			v = fields[f.From]
+		}
+		if err := setPath(doc, f.To, v); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// transactionFields returns every event field of transaction by proto name,
+// including unset ones, so templates and mappings never see a missing key.
+// Delivery metadata such as trace_context is not an event field.
+func transactionFields(transaction *pb.SubscribeStreamResponse) map[string]interface{} {
+	m := transaction.ProtoReflect()
+	fds := m.Descriptor().Fields()
+	fields := make(map[string]interface{}, fds.Len())
+	for i := 0; i < fds.Len(); i++ {
+		fd := fds.Get(i)
+		if isValueField(fd) {
+			fields[string(fd.Name())] = m.Get(fd).Interface()
+		}
+	}
+	return fields
+}
+
+// setPath stores v under a dot separated path, creating objects on the way.
+func setPath(doc map[string]interface{}, path string, v interface{}) error {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := doc[p]
+		if !ok {
+			child := make(map[string]interface{})
+			doc[p] = child
+			doc = child
+			continue
+		}
+		child, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%q is both a value and an object", p)
+		}
+		doc = child
+	}
+	doc[parts[len(parts)-1]] = v
+	return nil
+}
@@ -0,0 +1,363 @@
+// Package config loads the typed configuration of the server and the client.
+//
+// Every setting is read from, in increasing order of precedence:
+//
+//  1. the defaults already in the struct passed to Load
+//  2. an optional YAML (or JSON) config file, named by -config or CONFIG_FILE
+//  3. an optional .env file in the working directory
+//  4. the environment
+//  5. the command line
+//
+// Struct fields say where they are read from with tags: json for the config
+// file key, env for the environment variable, flag for the command line flag
+// and usage for its help text. Secrets should not have a flag so they never
+// show up in a process listing.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// DotEnvFile is read for environment variables that are not already set.
+// It is optional; the Docker images set everything in the environment.
+const DotEnvFile = ".env"
+
+// Load fills cfg, a pointer to a struct holding its defaults, from the config
+// file, .env, the environment and the command line in fs, parsed from args.
+// It does not validate the result; that is left to the caller once any
+// settings derived from others are filled in.
+func Load(cfg interface{}, fs *flag.FlagSet, args []string) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: Load needs a pointer to a struct, got %T", cfg)
+	}
+
+	fs.String("config", "", "A YAML or JSON config file (also CONFIG_FILE)")
+	for _, s := range settings(v.Elem()) {
+		if s.flag != "" {
+			fs.Var(flagValue{s}, s.flag, s.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return Reload(cfg, fs)
+}
+
+// Reload fills cfg, which should hold the defaults as for Load, from the same
+// sources again. The command line is the one Load already parsed into fs; the
+// config file and .env are read afresh.
+func Reload(cfg interface{}, fs *flag.FlagSet) error {
+	lookup, err := environment()
+	if err != nil {
+		return err
+	}
+	if path := File(fs, lookup); path != "" {
+		if err := ReadFile(path, cfg); err != nil {
+			return err
+		}
+	}
+
+	fields := settings(reflect.ValueOf(cfg).Elem())
+	flags := make(map[string]*setting)
+	for _, s := range fields {
+		if s.flag != "" {
+			flags[s.flag] = s
+		}
+		if s.env == "" {
+			continue
+		}
+		if value, ok := lookup(s.env); ok {
+			if err := set(s.value, value); err != nil {
+				return fmt.Errorf("%s: %v", s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		given, ok := f.Value.(flagValue)
+		s := flags[f.Name]
+		if !ok || s == nil || flagErr != nil {
+			return
+		}
+		if err := set(s.value, given.s.raw); err != nil {
+			flagErr = fmt.Errorf("-%s: %v", f.Name, err)
+		}
+	})
+	return flagErr
+}
+
+// File returns the config file named by -config or CONFIG_FILE, or "" if
+// there is none. lookup finds environment variables; nil means the process
+// environment and .env.
+func File(fs *flag.FlagSet, lookup func(string) (string, bool)) string {
+	if f := fs.Lookup("config"); f != nil && f.Value.String() != "" {
+		return f.Value.String()
+	}
+	if lookup == nil {
+		var err error
+		if lookup, err = environment(); err != nil {
+			lookup = os.LookupEnv
+		}
+	}
+	path, _ := lookup("CONFIG_FILE")
+	return path
+}
+
+// Lookup finds an environment variable in the process environment or, failing
+// that, .env. Use it for settings named by other settings, such as a secret
+// whose variable the config file names.
+func Lookup(key string) (string, bool) {
+	lookup, err := environment()
+	if err != nil {
+		return os.LookupEnv(key)
+	}
+	return lookup(key)
+}
+
+// environment returns a lookup that prefers the process environment over
+// .env, reading .env once.
+func environment() (func(string) (string, bool), error) {
+	dotEnv, err := readDotEnv(DotEnvFile)
+	if err != nil {
+		return nil, err
+	}
+	return func(key string) (string, bool) {
+		if value, ok := os.LookupEnv(key); ok {
+			return value, true
+		}
+		value, ok := dotEnv[key]
+		return value, ok
+	}, nil
+}
+
+// ReadFile overlays the YAML or JSON document at path onto cfg. Keys the
+// document leaves out keep their current value; unknown keys are an error so
+// a typo does not silently fall back to a default.
+func ReadFile(path string, cfg interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if doc == nil {
+		return nil
+	}
+
+	//Decode through JSON so the file uses the same keys and types as the json tags
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return nil
+}
+
+func readDotEnv(path string) (map[string]string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	env, err := godotenv.Read(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return env, nil
+}
+
+// setting is one field that can be set from the environment or a flag.
+type setting struct {
+	value reflect.Value
+	env   string
+	flag  string
+	usage string
+	raw   string // the command line value, if the flag was given
+}
+
+// settings walks the struct, descending into nested structs that are not
+// themselves settings.
+func settings(v reflect.Value) []*setting {
+	var out []*setting
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		env, flagName := f.Tag.Get("env"), f.Tag.Get("flag")
+		if env == "" && flagName == "" {
+			if f.Type.Kind() == reflect.Struct && f.Type != durationType {
+				out = append(out, settings(v.Field(i))...)
+			}
+			continue
+		}
+		out = append(out, &setting{value: v.Field(i), env: env, flag: flagName, usage: f.Tag.Get("usage")})
+	}
+	return out
+}
+
+// flagValue holds the command line value until the other sources are loaded
+// so the flag, which is set first, can still be applied last.
+type flagValue struct {
+	s *setting
+}
+
+func (f flagValue) String() string {
+	if f.s == nil {
+		return ""
+	}
+	return format(f.s.value)
+}
+
+func (f flagValue) Set(value string) error {
+	//Check the value now so flag reports the mistake with its usage
+	if err := set(reflect.New(f.s.value.Type()).Elem(), value); err != nil {
+		return err
+	}
+	f.s.raw = value
+	return nil
+}
+
+func (f flagValue) IsBoolFlag() bool {
+	return f.s != nil && f.s.value.Kind() == reflect.Bool
+}
+
+var durationType = reflect.TypeOf(Duration{})
+
+// set parses value into v according to v's type.
+func set(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(Duration{d}))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %v", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+func format(v reflect.Value) string {
+	if v.Type() == durationType {
+		return v.Interface().(Duration).String()
+	}
+	if v.Kind() == reflect.Slice {
+		return strings.Join(v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// Duration is a time.Duration read from strings such as "5s". A bare number
+// is a count of seconds, which is how STREAM_SLEEP has always been given.
+type Duration struct {
+	time.Duration
+}
+
+// ParseDuration parses "1m30s" style durations or a number of seconds.
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(n * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a duration such as 30s or 5m", s)
+	}
+	return d, nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		parsed, err := ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		d.Duration = parsed
+	case float64:
+		d.Duration = time.Duration(v * float64(time.Second))
+	default:
+		return fmt.Errorf("%s is not a duration such as \"30s\"", b)
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Errors collects every problem found while validating a config so they can
+// all be fixed at once instead of one restart at a time.
+type Errors []string
+
+// Addf records a problem.
+func (e *Errors) Addf(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// Err returns the problems as one error, or nil if there were none.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  - " + strings.Join(e, "\n  - "))
+}
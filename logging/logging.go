@@ -0,0 +1,132 @@
+// Package logging sets up the structured JSON logs of the server and the
+// client. Every line is one JSON object with a level, a time, the service and
+// the fields of the request or stream it is about. Secrets and tokens are
+// redacted before anything is written.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/grpclog"
+)
+
+// Formats logs can be written in. Console is for reading logs in a terminal;
+// it is redacted the same way.
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// Levels are the log levels that can be configured, in increasing order of
+// severity. Messages below the configured level are discarded.
+var levels = map[string]zerolog.Level{
+	"debug": zerolog.DebugLevel,
+	"info":  zerolog.InfoLevel,
+	"warn":  zerolog.WarnLevel,
+	"error": zerolog.ErrorLevel,
+}
+
+// ValidLevel reports whether name can be passed to SetLevel.
+func ValidLevel(name string) bool {
+	_, ok := levels[name]
+	return ok
+}
+
+// ValidFormat reports whether format can be passed to New.
+func ValidFormat(format string) bool {
+	return format == FormatJSON || format == FormatConsole
+}
+
+// SetLevel changes the level of every logger, at runtime. name has been
+// validated.
+func SetLevel(name string) {
+	zerolog.SetGlobalLevel(levels[name])
+}
+
+// New returns a logger for service writing to stderr in format. Any format
+// other than console is JSON.
+func New(service, format string) zerolog.Logger {
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+	var w io.Writer = os.Stderr
+	if format == FormatConsole {
+		w = zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}
+	}
+	return zerolog.New(redactingWriter{w}).With().Timestamp().Str("service", service).Logger()
+}
+
+// Sampled returns l for events logged for every transaction. Of each level
+// below error, the first 10 messages a second are written and then only every
+// 100th. Errors are always written.
+func Sampled(l zerolog.Logger) zerolog.Logger {
+	sampler := func() zerolog.Sampler {
+		return &zerolog.BurstSampler{Burst: 10, Period: time.Second, NextSampler: &zerolog.BasicSampler{N: 100}}
+	}
+	return l.Sample(zerolog.LevelSampler{DebugSampler: sampler(), InfoSampler: sampler(), WarnSampler: sampler()})
+}
+
+var (
+	//A secret-looking field, at any depth, keeps its key and loses its value
+	secretField = regexp.MustCompile(`"(password|secret|client_secret|access_secret|admin_token|api_key|x_api_key|token|access_token|authorization)":"(?:[^"\\]|\\.)*"`)
+	jwtPattern  = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`)
+	bearer      = regexp.MustCompile(`(?i)bearer [^\s"\\]+`)
+)
+
+// redactingWriter removes secrets and tokens from each JSON line before
+// passing it on. Tokens are recognized anywhere, including in messages and
+// errors; other secrets by their field name.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	out := secretField.ReplaceAll(p, []byte(`"$1":"[REDACTED]"`))
+	out = bearer.ReplaceAll(out, []byte("Bearer [REDACTED]"))
+	out = jwtPattern.ReplaceAll(out, []byte("[REDACTED]"))
+	if _, err := r.w.Write(out); err != nil {
+		return 0, err
+	}
+	//zerolog wants to hear that all of its line was written
+	return len(p), nil
+}
+
+// GRPCLogger returns a grpclog.LoggerV2 that writes gRPC's own logs through
+// l, tagged component=grpc. gRPC's info messages are logged at debug level.
+func GRPCLogger(l zerolog.Logger) grpclog.LoggerV2 {
+	return grpcLogger{l.With().Str("component", "grpc").Logger()}
+}
+
+type grpcLogger struct {
+	l zerolog.Logger
+}
+
+func (g grpcLogger) Info(args ...interface{})   { g.l.Debug().Msg(fmt.Sprint(args...)) }
+func (g grpcLogger) Infoln(args ...interface{}) { g.l.Debug().Msg(fmt.Sprint(args...)) }
+func (g grpcLogger) Infof(format string, args ...interface{}) {
+	g.l.Debug().Msgf(format, args...)
+}
+func (g grpcLogger) Warning(args ...interface{})   { g.l.Warn().Msg(fmt.Sprint(args...)) }
+func (g grpcLogger) Warningln(args ...interface{}) { g.l.Warn().Msg(fmt.Sprint(args...)) }
+func (g grpcLogger) Warningf(format string, args ...interface{}) {
+	g.l.Warn().Msgf(format, args...)
+}
+func (g grpcLogger) Error(args ...interface{})   { g.l.Error().Msg(fmt.Sprint(args...)) }
+func (g grpcLogger) Errorln(args ...interface{}) { g.l.Error().Msg(fmt.Sprint(args...)) }
+func (g grpcLogger) Errorf(format string, args ...interface{}) {
+	g.l.Error().Msgf(format, args...)
+}
+func (g grpcLogger) Fatal(args ...interface{})   { g.l.Fatal().Msg(fmt.Sprint(args...)) }
+func (g grpcLogger) Fatalln(args ...interface{}) { g.l.Fatal().Msg(fmt.Sprint(args...)) }
+func (g grpcLogger) Fatalf(format string, args ...interface{}) {
+	g.l.Fatal().Msgf(format, args...)
+}
+
+// V reports whether verbosity level v is enabled. gRPC's verbose logs are
+// only wanted at debug level.
+func (g grpcLogger) V(v int) bool {
+	return v <= 0 || zerolog.GlobalLevel() <= zerolog.DebugLevel
+}
@@ -1,4 +1,8 @@
 // Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.12.4
+// source: pubsub/pub_sub.proto
 
 package go_grpc_test
 
@@ -20,6 +24,9 @@ const _ = grpc.SupportPackageIsVersion7
 type PubsubClient interface {
 	// A server-to-client streaming RPC.
 	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Pubsub_SubscribeClient, error)
+	// Streams the orders created in a past window, marked replayed, and ends.
+	// For filling gaps after an outage.
+	Replay(ctx context.Context, in *ReplayRequest, opts ...grpc.CallOption) (Pubsub_ReplayClient, error)
 }
 
 type pubsubClient struct {
@@ -62,12 +69,47 @@ func (x *pubsubSubscribeClient) Recv() (*SubscribeStreamResponse, error) {
 	return m, nil
 }
 
+func (c *pubsubClient) Replay(ctx context.Context, in *ReplayRequest, opts ...grpc.CallOption) (Pubsub_ReplayClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Pubsub_ServiceDesc.Streams[1], "/pb_pubsub.Pubsub/Replay", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pubsubReplayClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Pubsub_ReplayClient interface {
+	Recv() (*SubscribeStreamResponse, error)
+	grpc.ClientStream
+}
+
+type pubsubReplayClient struct {
+	grpc.ClientStream
+}
+
+func (x *pubsubReplayClient) Recv() (*SubscribeStreamResponse, error) {
+	m := new(SubscribeStreamResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // PubsubServer is the server API for Pubsub service.
 // All implementations must embed UnimplementedPubsubServer
 // for forward compatibility
 type PubsubServer interface {
 	// A server-to-client streaming RPC.
 	Subscribe(*SubscribeRequest, Pubsub_SubscribeServer) error
+	// Streams the orders created in a past window, marked replayed, and ends.
+	// For filling gaps after an outage.
+	Replay(*ReplayRequest, Pubsub_ReplayServer) error
 	mustEmbedUnimplementedPubsubServer()
 }
 
@@ -78,6 +120,9 @@ type UnimplementedPubsubServer struct {
 func (UnimplementedPubsubServer) Subscribe(*SubscribeRequest, Pubsub_SubscribeServer) error {
 	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
 }
+func (UnimplementedPubsubServer) Replay(*ReplayRequest, Pubsub_ReplayServer) error {
+	return status.Errorf(codes.Unimplemented, "method Replay not implemented")
+}
 func (UnimplementedPubsubServer) mustEmbedUnimplementedPubsubServer() {}
 
 // UnsafePubsubServer may be embedded to opt out of forward compatibility for this service.
@@ -112,6 +157,27 @@ func (x *pubsubSubscribeServer) Send(m *SubscribeStreamResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _Pubsub_Replay_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReplayRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PubsubServer).Replay(m, &pubsubReplayServer{stream})
+}
+
+type Pubsub_ReplayServer interface {
+	Send(*SubscribeStreamResponse) error
+	grpc.ServerStream
+}
+
+type pubsubReplayServer struct {
+	grpc.ServerStream
+}
+
+func (x *pubsubReplayServer) Send(m *SubscribeStreamResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // Pubsub_ServiceDesc is the grpc.ServiceDesc for Pubsub service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -125,6 +191,97 @@ var Pubsub_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _Pubsub_Subscribe_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "Replay",
+			Handler:       _Pubsub_Replay_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pubsub/pub_sub.proto",
+}
+
+// AuthClient is the client API for Auth service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AuthClient interface {
+	Token(ctx context.Context, in *TokenRequest, opts ...grpc.CallOption) (*TokenResponse, error)
+}
+
+type authClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAuthClient(cc grpc.ClientConnInterface) AuthClient {
+	return &authClient{cc}
+}
+
+func (c *authClient) Token(ctx context.Context, in *TokenRequest, opts ...grpc.CallOption) (*TokenResponse, error) {
+	out := new(TokenResponse)
+	err := c.cc.Invoke(ctx, "/pb_pubsub.Auth/Token", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AuthServer is the server API for Auth service.
+// All implementations must embed UnimplementedAuthServer
+// for forward compatibility
+type AuthServer interface {
+	Token(context.Context, *TokenRequest) (*TokenResponse, error)
+	mustEmbedUnimplementedAuthServer()
+}
+
+// UnimplementedAuthServer must be embedded to have forward compatible implementations.
+type UnimplementedAuthServer struct {
+}
+
+func (UnimplementedAuthServer) Token(context.Context, *TokenRequest) (*TokenResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Token not implemented")
+}
+func (UnimplementedAuthServer) mustEmbedUnimplementedAuthServer() {}
+
+// UnsafeAuthServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AuthServer will
+// result in compilation errors.
+type UnsafeAuthServer interface {
+	mustEmbedUnimplementedAuthServer()
+}
+
+func RegisterAuthServer(s grpc.ServiceRegistrar, srv AuthServer) {
+	s.RegisterService(&Auth_ServiceDesc, srv)
+}
+
+func _Auth_Token_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthServer).Token(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb_pubsub.Auth/Token",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthServer).Token(ctx, req.(*TokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Auth_ServiceDesc is the grpc.ServiceDesc for Auth service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Auth_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pb_pubsub.Auth",
+	HandlerType: (*AuthServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Token",
+			Handler:    _Auth_Token_Handler,
+		},
 	},
+	Streams:  []grpc.StreamDesc{},
 	Metadata: "pubsub/pub_sub.proto",
 }
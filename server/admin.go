@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// tenantStatus is a tenant's poller as the admin API shows it.
+type tenantStatus struct {
+	ID                  string `json:"id"`
+	Cursor              string `json:"cursor"`
+	Paused              bool   `json:"paused"`
+	Subscribers         int    `json:"subscribers"`
+	LastPoll            string `json:"last_poll,omitempty"`
+	LastError           string `json:"last_error,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Serving             bool   `json:"serving"`
+	NotServingReason    string `json:"not_serving_reason,omitempty"`
+}
+
+// subscriberStatus is an active subscription as the admin API shows it.
+type subscriberStatus struct {
+	ID             uint64 `json:"id"`
+	Tenant         string `json:"tenant"`
+	Subscriber     string `json:"subscriber"`
+	Peer           string `json:"peer"`
+	Topic          string `json:"topic"`
+	ConnectedSince string `json:"connected_since"`
+	// LagSeconds is how long after its creation the last order was sent.
+	LagSeconds float64 `json:"lag_seconds"`
+	// QueuedPolls is how many polls the subscriber has yet to be sent. It is
+	// dropped at subscriberBuffer.
+	QueuedPolls int `json:"queued_polls"`
+	// Filters is what the policy lets the subscriber see, any one of them;
+	// none means everything. The server's filter applies on top.
+	Filters []Filter `json:"filters,omitempty"`
+}
+
+func (t *tenant) status() tenantStatus {
+	t.mu.Lock()
+	st := tenantStatus{
+		ID:                  t.id,
+		Cursor:              t.cursor.UTC().Format(time.RFC3339),
+		Paused:              t.paused,
+		Subscribers:         len(t.subscribers),
+		ConsecutiveFailures: t.failures,
+	}
+	if !t.lastPoll.IsZero() {
+		st.LastPoll = t.lastPoll.UTC().Format(time.RFC3339)
+	}
+	if t.lastError != nil {
+		st.LastError = t.lastError.Error()
+	}
+	t.mu.Unlock()
+	st.NotServingReason = t.server.health.reason(t.id)
+	st.Serving = st.NotServingReason == ""
+	return st
+}
+
+func (t *tenant) subscriberStatuses(pol *Policy) []subscriberStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]subscriberStatus, 0, len(t.subscribers))
+	for sub := range t.subscribers {
+		st := subscriberStatus{
+			ID:             sub.id,
+			Tenant:         t.id,
+			Subscriber:     sub.principal.Subject,
+			Peer:           sub.peer,
+			Topic:          sub.topic,
+			ConnectedSince: sub.since.UTC().Format(time.RFC3339),
+			LagSeconds:     time.Duration(atomic.LoadInt64(&sub.lag)).Seconds(),
+			QueuedPolls:    len(sub.batches),
+		}
+		if access := pol.Authorize(sub.principal, ordersTopic, actionSubscribe); access != nil && !access.all {
+			st.Filters = access.grants
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// serveAdmin serves the admin API at http://<addr>/admin/ until ctx is done.
+func (s *pubSubServer) serveAdmin(ctx context.Context, addr string) {
+	srv := &http.Server{Addr: addr, Handler: s.adminHandler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logger.Info().Str("addr", addr).Msg("Serving the admin API at /admin/")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error().Err(err).Msg("Serving the admin API")
+	}
+}
+
+// adminHandler routes the admin API. Every request needs the admin token as
+// a bearer token:
+//
+//	GET    /admin/tenants                 every tenant's poller
+//	GET    /admin/tenants/<id>            one tenant's poller
+//	POST   /admin/tenants/<id>/pause      stop polling on the interval
+//	POST   /admin/tenants/<id>/resume     poll on the interval again
+//	POST   /admin/tenants/<id>/poll       poll right away
+//	GET    /admin/subscribers[?tenant=]   active subscriptions
+//	DELETE /admin/subscribers/<id>        disconnect a subscriber
+func (s *pubSubServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/tenants", s.adminTenants)
+	mux.HandleFunc("/admin/tenants/", s.adminTenant)
+	mux.HandleFunc("/admin/subscribers", s.adminSubscribers)
+	mux.HandleFunc("/admin/subscribers/", s.adminSubscriber)
+	return s.adminAuth(mux)
+}
+
+// adminAuth lets through requests bearing the current admin token.
+func (s *pubSubServer) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := s.config().AdminToken
+		header := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(header, "Bearer ")
+		if token == "" || given == header || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			logger.Warn().Str("peer", r.RemoteAddr).Str("method", r.Method).Str("path", r.URL.Path).Msg("Refused an admin request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			adminError(w, http.StatusUnauthorized, "the admin token is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *pubSubServer) adminTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	out := make([]tenantStatus, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		out = append(out, t.status())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	adminJSON(w, out)
+}
+
+func (s *pubSubServer) adminTenant(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/tenants/"), "/")
+	t, ok := s.tenants[parts[0]]
+	if !ok || len(parts) > 2 {
+		adminError(w, http.StatusNotFound, "no such tenant")
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			adminError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		adminJSON(w, t.status())
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	switch parts[1] {
+	case "pause":
+		t.setPaused(true)
+	case "resume":
+		t.setPaused(false)
+	case "poll":
+		t.triggerPoll()
+	default:
+		adminError(w, http.StatusNotFound, "unknown action, use pause, resume or poll")
+		return
+	}
+	logger.Info().Str("peer", r.RemoteAddr).Str("tenant", t.id).Str("action", parts[1]).Msg("Admin action")
+	adminJSON(w, t.status())
+}
+
+func (s *pubSubServer) adminSubscribers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	tenantID := r.URL.Query().Get("tenant")
+	if _, ok := s.tenants[tenantID]; tenantID != "" && !ok {
+		adminError(w, http.StatusNotFound, "no such tenant")
+		return
+	}
+	pol := s.config().Policy
+	out := []subscriberStatus{}
+	for id, t := range s.tenants {
+		if tenantID == "" || id == tenantID {
+			out = append(out, t.subscriberStatuses(pol)...)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	adminJSON(w, out)
+}
+
+func (s *pubSubServer) adminSubscriber(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		adminError(w, http.StatusMethodNotAllowed, "use DELETE to disconnect a subscriber")
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/subscribers/"), 10, 64)
+	if err != nil {
+		adminError(w, http.StatusNotFound, "no such subscriber")
+		return
+	}
+	for _, t := range s.tenants {
+		if t.kick(id) {
+			logger.Info().Str("peer", r.RemoteAddr).Str("tenant", t.id).Uint64("subscription", id).Msg("Admin disconnected a subscriber")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	adminError(w, http.StatusNotFound, "no such subscriber")
+}
+
+func adminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func adminError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
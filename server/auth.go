@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// principal is the authenticated subscriber behind a call.
+type principal struct {
+	Subject string
+	Tenant  string
+	Claims  jwt.MapClaims
+	// Expires is when the token runs out, if it does. Streams end then so
+	// the subscriber comes back with a fresh one.
+	Expires time.Time
+}
+
+type principalKey struct{}
+
+// principalFrom returns the subscriber authenticated by the auth interceptor.
+func principalFrom(ctx context.Context) principal {
+	p, _ := ctx.Value(principalKey{}).(principal)
+	return p
+}
+
+// authStreamInterceptor verifies the bearer JWT in the authorization metadata
+// of every stream and records who the subscriber is and which tenant they
+// belong to. Without tenants or an access secret every subscriber is let in
+// as the default tenant. Health checks and reflection need no token.
+func (s *pubSubServer) authStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if publicMethod(info.FullMethod) {
+		//Health watches and reflection end with the shutdown so they do not hold up a graceful stop
+		ctx, cancel := context.WithCancel(stream.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-s.shutdown:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		wrapped := grpc_middleware.WrapServerStream(stream)
+		wrapped.WrappedContext = ctx
+		return handler(srv, wrapped)
+	}
+	p, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	addLogFields(stream.Context(), func(c zerolog.Context) zerolog.Context {
+		return c.Str("subscriber", p.Subject).Str("tenant", p.Tenant)
+	})
+	wrapped := grpc_middleware.WrapServerStream(stream)
+	wrapped.WrappedContext = context.WithValue(stream.Context(), principalKey{}, p)
+	return handler(srv, wrapped)
+}
+
+func (s *pubSubServer) authenticate(ctx context.Context) (principal, error) {
+	cfg := s.config()
+	if !cfg.authRequired() {
+		return principal{Tenant: defaultTenant}, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 || !strings.HasPrefix(values[0], "Bearer ") {
+		return principal{}, status.Error(codes.Unauthenticated, "a bearer token is required")
+	}
+	claims, err := s.verifyToken(ctx, strings.TrimPrefix(values[0], "Bearer "))
+	if err != nil {
+		return principal{}, status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+
+	p := principal{Claims: claims}
+	p.Subject, _ = claims["sub"].(string)
+	p.Tenant, _ = claims["tenant"].(string)
+	if exp, ok := claims["exp"].(float64); ok {
+		p.Expires = time.Unix(int64(exp), 0)
+	}
+	if len(cfg.Tenants) == 0 && p.Tenant == "" {
+		p.Tenant = defaultTenant
+	}
+	if _, ok := cfg.tenant(p.Tenant); !ok {
+		return principal{}, status.Errorf(codes.PermissionDenied, "token is not for a tenant of this server")
+	}
+	return p, nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ransdepm/go-grpc-test/config"
+	"github.com/ransdepm/go-grpc-test/logging"
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"github.com/ransdepm/go-grpc-test/tracing"
+)
+
+// Config is everything the server reads at startup. See package config for
+// where each setting can come from. On SIGHUP, or when the config file
+// changes, it is loaded again and everything except Port applies live.
+type Config struct {
+	Port            int             `json:"port" env:"PORT" flag:"port" usage:"The port to serve gRPC on"`
+	PollInterval    config.Duration `json:"poll_interval" env:"STREAM_SLEEP" flag:"poll_interval" usage:"How often subscribers are sent new orders; a bare number is seconds"`
+	ShutdownTimeout config.Duration `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown_timeout" usage:"How long to wait for subscribers to disconnect on shutdown before closing their streams"`
+	LogLevel        string          `json:"log_level" env:"LOG_LEVEL" flag:"log_level" usage:"debug, info, warn or error"`
+	LogFormat       string          `json:"log_format" env:"LOG_FORMAT" flag:"log_format" usage:"json, or console for reading logs in a terminal"`
+	MetricsAddr     string          `json:"metrics_addr" env:"METRICS_ADDR" flag:"metrics_addr" usage:"If set, serve Prometheus metrics at http://<metrics_addr>/metrics"`
+	AdminAddr       string          `json:"admin_addr" env:"ADMIN_ADDR" flag:"admin_addr" usage:"If set, serve the admin API at http://<admin_addr>/admin/"`
+	UnhealthyAfter  int             `json:"unhealthy_after" env:"UNHEALTHY_AFTER" flag:"unhealthy_after" usage:"How many polls in a row may fail before the health service reports NOT_SERVING"`
+	MaxReplays      int             `json:"max_replays" env:"MAX_REPLAYS" flag:"max_replays" usage:"How many replays may run at once; 0 refuses them"`
+	ReplayRate      float64         `json:"replay_rate" env:"REPLAY_RATE" flag:"replay_rate" usage:"How many orders a second all replays together may send"`
+	Reflection      bool            `json:"reflection" env:"REFLECTION" flag:"reflection" usage:"Serve the gRPC reflection service, for grpcurl and the like"`
+	TraceExporter   string          `json:"trace_exporter" env:"TRACE_EXPORTER" flag:"trace_exporter" usage:"Where to send OpenTelemetry spans: none or stdout"`
+
+	// UpstreamEnv selects the upstream profile, a built-in one or one from
+	// Upstreams. UpstreamURL, if set, overrides the profile's base URL.
+	UpstreamEnv string              `json:"upstream_env" env:"UPSTREAM_ENV" flag:"upstream_env" usage:"The upstream environment profile: dev, staging, prod or one defined under upstreams"`
+	UpstreamURL string              `json:"upstream_url" env:"UPSTREAM_URL" flag:"upstream_url" usage:"Overrides the base URL of the upstream profile"`
+	Upstreams   map[string]Upstream `json:"upstreams,omitempty"`
+	// Upstream is the profile in effect, filled in by Validate.
+	Upstream Upstream `json:"-"`
+	// APIKey authenticates the server with the upstream transactions API
+	// when no Tenants are configured.
+	APIKey string `json:"api_key" env:"X_API_KEY"`
+	// AdminToken is the bearer token the admin API requires. It is separate
+	// from every client credential.
+	AdminToken string `json:"admin_token" env:"ADMIN_TOKEN"`
+	// AccessSecret signs the JWTs clients present with HS256. With a JWKS,
+	// set it only while clients move over to asymmetrically signed tokens.
+	AccessSecret string `json:"access_secret" env:"ACCESS_SECRET"`
+	// JWT verifies RS256/ES256 signed tokens against a JWK set and signs
+	// the tokens the server issues. Without it or AccessSecret, and without
+	// Tenants, subscribers are not authenticated.
+	JWT JWTConfig `json:"jwt"`
+	// Signer is the loaded JWT.SigningKey, filled in by Validate.
+	Signer *signingKey `json:"-"`
+
+	// Clients may exchange their id and secret for a token through the Auth
+	// service.
+	Clients []ClientConfig `json:"clients,omitempty"`
+
+	// Tenants are the organizations the server polls for, each with its own
+	// upstream credentials. Subscribers are mapped to one by the tenant claim
+	// of their JWT.
+	Tenants []TenantConfig `json:"tenants,omitempty"`
+
+	// Filter limits the orders sent to every subscriber.
+	Filter Filter `json:"filter"`
+
+	// PolicyFile decides who may subscribe to what and which events they
+	// see. Without one every authenticated subscriber sees all its tenant's
+	// orders.
+	PolicyFile string  `json:"policy_file" env:"POLICY_FILE" flag:"policy_file" usage:"A YAML or JSON authorization policy"`
+	Policy     *Policy `json:"-"`
+}
+
+// JWTConfig is where the public keys of token issuers come from, what the
+// tokens must be issued for, and how the server issues its own.
+type JWTConfig struct {
+	JWKSFile    string          `json:"jwks_file" env:"JWKS_FILE" flag:"jwks_file" usage:"A JWK set file with the keys subscriber tokens are signed with"`
+	JWKSURL     string          `json:"jwks_url" env:"JWKS_URL" flag:"jwks_url" usage:"A URL serving the JWK set subscriber tokens are signed with"`
+	JWKSRefresh config.Duration `json:"jwks_refresh" env:"JWKS_REFRESH" flag:"jwks_refresh" usage:"How often the JWK set is loaded again"`
+	Audience    string          `json:"audience" env:"JWT_AUDIENCE" flag:"jwt_audience" usage:"If set, tokens must list it in aud"`
+	Issuer      string          `json:"issuer" env:"JWT_ISSUER" flag:"jwt_issuer" usage:"If set, tokens must have it as iss"`
+
+	SigningKey    string          `json:"signing_key" env:"JWT_SIGNING_KEY" flag:"jwt_signing_key" usage:"A PEM RSA or ECDSA private key file to sign issued tokens with"`
+	SigningKeyID  string          `json:"signing_key_id" env:"JWT_SIGNING_KEY_ID" usage:"The kid of issued tokens (default derived from the key)"`
+	TokenLifetime config.Duration `json:"token_lifetime" env:"TOKEN_LIFETIME" flag:"token_lifetime" usage:"How long issued tokens are valid"`
+}
+
+func (c JWTConfig) jwks() bool {
+	return c.JWKSFile != "" || c.JWKSURL != ""
+}
+
+// asymmetric reports whether tokens are verified with public keys, of the
+// JWK set or the signing key.
+func (c JWTConfig) asymmetric() bool {
+	return c.jwks() || c.SigningKey != ""
+}
+
+// TenantConfig is one organization. Its API key is given directly or, to keep
+// it out of the config file, as the name of an environment variable.
+type TenantConfig struct {
+	ID        string `json:"id"`
+	APIKey    string `json:"api_key,omitempty"`
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+}
+
+// client returns the client with id.
+func (c *Config) client(id string) (ClientConfig, bool) {
+	for _, cl := range c.Clients {
+		if cl.ID == id {
+			return cl, true
+		}
+	}
+	return ClientConfig{}, false
+}
+
+// defaultTenant is the only tenant when none are configured. It polls with
+// APIKey and serves every subscriber.
+const defaultTenant = "default"
+
+// tenants returns the configured tenants, or the default one.
+func (c *Config) tenants() []TenantConfig {
+	if len(c.Tenants) == 0 {
+		return []TenantConfig{{ID: defaultTenant, APIKey: c.APIKey}}
+	}
+	return c.Tenants
+}
+
+// tenant returns the tenant with id.
+func (c *Config) tenant(id string) (TenantConfig, bool) {
+	for _, t := range c.tenants() {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return TenantConfig{}, false
+}
+
+// authRequired reports whether subscribers must present a JWT.
+func (c *Config) authRequired() bool {
+	return c.AccessSecret != "" || c.JWT.asymmetric() || len(c.Tenants) > 0
+}
+
+// Filter keeps only the orders matching every non-empty list.
+type Filter struct {
+	VenueIDs  []int64  `json:"venue_ids,omitempty"`
+	VendorIDs []int64  `json:"vendor_ids,omitempty"`
+	Types     []string `json:"types,omitempty"`
+}
+
+// Matches reports whether transaction passes the filter.
+func (f Filter) Matches(transaction *pb.SubscribeStreamResponse) bool {
+	return containsID(f.VenueIDs, transaction.VenueId) &&
+		containsID(f.VendorIDs, transaction.VendorId) &&
+		containsString(f.Types, transaction.Type)
+}
+
+func containsID(ids []int64, id int64) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:            50005,
+		PollInterval:    config.Duration{Duration: 10 * time.Second},
+		ShutdownTimeout: config.Duration{Duration: 30 * time.Second},
+		LogLevel:        "info",
+		LogFormat:       logging.FormatJSON,
+		UnhealthyAfter:  3,
+		MaxReplays:      2,
+		ReplayRate:      100,
+		UpstreamEnv:     "dev",
+		TraceExporter:   tracing.ExporterNone,
+		JWT: JWTConfig{
+			JWKSRefresh:   config.Duration{Duration: 5 * time.Minute},
+			TokenLifetime: config.Duration{Duration: 15 * time.Minute},
+		},
+	}
+}
+
+// loadConfig reads and validates the server config.
+func loadConfig() (*Config, error) {
+	c := defaultConfig()
+	if err := config.Load(c, flag.CommandLine, os.Args[1:]); err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// reloadConfig reads and validates the server config again, keeping the
+// command line given at startup.
+func reloadConfig() (*Config, error) {
+	c := defaultConfig()
+	if err := config.Reload(c, flag.CommandLine); err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// Validate reports every problem with the config at once.
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if c.Port < 1 || c.Port > 65535 {
+		errs.Addf("port (PORT, -port) must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.PollInterval.Duration < time.Second {
+		errs.Addf("poll_interval (STREAM_SLEEP, -poll_interval) must be at least 1s, got %v", c.PollInterval)
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		errs.Addf("shutdown_timeout (SHUTDOWN_TIMEOUT, -shutdown_timeout) must be positive, got %v", c.ShutdownTimeout)
+	}
+	if !logging.ValidLevel(c.LogLevel) {
+		errs.Addf("log_level (LOG_LEVEL, -log_level) must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	if !logging.ValidFormat(c.LogFormat) {
+		errs.Addf("log_format (LOG_FORMAT, -log_format) must be json or console, got %q", c.LogFormat)
+	}
+	if c.AdminAddr != "" && c.AdminToken == "" {
+		errs.Addf("admin_token (ADMIN_TOKEN) is required to serve the admin API on admin_addr")
+	}
+	if c.UnhealthyAfter < 1 {
+		errs.Addf("unhealthy_after (UNHEALTHY_AFTER, -unhealthy_after) must be at least 1, got %d", c.UnhealthyAfter)
+	}
+	if c.MaxReplays < 0 {
+		errs.Addf("max_replays (MAX_REPLAYS, -max_replays) must not be negative, got %d", c.MaxReplays)
+	}
+	if c.ReplayRate <= 0 {
+		errs.Addf("replay_rate (REPLAY_RATE, -replay_rate) must be positive, got %v", c.ReplayRate)
+	}
+	if !tracing.ValidExporter(c.TraceExporter) {
+		errs.Addf("trace_exporter (TRACE_EXPORTER, -trace_exporter) must be none or stdout, got %q", c.TraceExporter)
+	}
+	if upstream, err := c.resolveUpstream(); err != nil {
+		errs.Addf("%v", err)
+	} else {
+		c.Upstream = upstream
+	}
+	if len(c.Tenants) == 0 && c.APIKey == "" {
+		errs.Addf("api_key (X_API_KEY) is required to poll the upstream for orders, or configure tenants")
+	}
+	if len(c.Tenants) > 0 && c.AccessSecret == "" && !c.JWT.asymmetric() {
+		errs.Addf("jwt.jwks_file, jwt.jwks_url, jwt.signing_key or access_secret is required with tenants to verify the tenant claim of subscribers")
+	}
+	if c.JWT.JWKSFile != "" && c.JWT.JWKSURL != "" {
+		errs.Addf("set one of jwt.jwks_file (JWKS_FILE, -jwks_file) and jwt.jwks_url (JWKS_URL, -jwks_url), not both")
+	}
+	if c.JWT.JWKSRefresh.Duration < jwksMinRefresh {
+		errs.Addf("jwt.jwks_refresh (JWKS_REFRESH, -jwks_refresh) must be at least %v, got %v", jwksMinRefresh, c.JWT.JWKSRefresh)
+	}
+	if c.JWT.SigningKey != "" {
+		signer, err := loadSigningKey(c.JWT.SigningKey, c.JWT.SigningKeyID)
+		if err != nil {
+			errs.Addf("jwt.signing_key (JWT_SIGNING_KEY, -jwt_signing_key): %v", err)
+		}
+		c.Signer = signer
+	}
+	if c.JWT.TokenLifetime.Duration < time.Minute {
+		errs.Addf("jwt.token_lifetime (TOKEN_LIFETIME, -token_lifetime) must be at least 1m, got %v", c.JWT.TokenLifetime)
+	}
+	if c.PolicyFile != "" {
+		policy, err := loadPolicy(c.PolicyFile)
+		if err != nil {
+			errs.Addf("policy_file (POLICY_FILE, -policy_file): %v", err)
+		}
+		c.Policy = policy
+	}
+	ids := make(map[string]bool)
+	for i := range c.Tenants {
+		t := &c.Tenants[i]
+		switch {
+		case t.ID == "":
+			errs.Addf("tenants[%d]: id is required", i)
+		case strings.Contains(t.ID, "/"):
+			errs.Addf("tenant %q: id must not contain /", t.ID)
+		case ids[t.ID]:
+			errs.Addf("tenant %q is defined twice", t.ID)
+		}
+		ids[t.ID] = true
+		if t.APIKeyEnv != "" {
+			t.APIKey, _ = config.Lookup(t.APIKeyEnv)
+		}
+		if t.APIKey == "" {
+			errs.Addf("tenant %q: api_key, or an api_key_env that is set, is required", t.ID)
+		}
+	}
+	if len(c.Clients) > 0 && c.JWT.SigningKey == "" && c.AccessSecret == "" {
+		errs.Addf("jwt.signing_key or access_secret is required to issue tokens to clients")
+	}
+	clientIDs := make(map[string]bool)
+	for i := range c.Clients {
+		cl := &c.Clients[i]
+		switch {
+		case cl.ID == "":
+			errs.Addf("clients[%d]: id is required", i)
+		case clientIDs[cl.ID]:
+			errs.Addf("client %q is defined twice", cl.ID)
+		}
+		clientIDs[cl.ID] = true
+		if cl.SecretEnv != "" {
+			cl.Secret, _ = config.Lookup(cl.SecretEnv)
+		}
+		if cl.Secret == "" {
+			errs.Addf("client %q: secret, or a secret_env that is set, is required", cl.ID)
+		}
+		if len(c.Tenants) > 0 {
+			if _, ok := c.tenant(cl.Tenant); !ok {
+				errs.Addf("client %q: tenant must be one of %s, got %q", cl.ID, tenantIDs(c), cl.Tenant)
+			}
+		}
+	}
+	return errs.Err()
+}
+
+// changes describes how next differs from c, without revealing secrets, and
+// lists the changes that only take effect after a restart. Those are reset
+// in next to their current values.
+func (c *Config) changes(next *Config) (live, restart []string) {
+	if c.Port != next.Port {
+		restart = append(restart, fmt.Sprintf("port %d -> %d", c.Port, next.Port))
+		next.Port = c.Port
+	}
+	if c.PollInterval != next.PollInterval {
+		live = append(live, fmt.Sprintf("poll_interval %v -> %v", c.PollInterval, next.PollInterval))
+	}
+	if c.ShutdownTimeout != next.ShutdownTimeout {
+		live = append(live, fmt.Sprintf("shutdown_timeout %v -> %v", c.ShutdownTimeout, next.ShutdownTimeout))
+	}
+	if c.MetricsAddr != next.MetricsAddr {
+		restart = append(restart, fmt.Sprintf("metrics_addr %s -> %s", c.MetricsAddr, next.MetricsAddr))
+		next.MetricsAddr = c.MetricsAddr
+	}
+	if c.AdminAddr != next.AdminAddr {
+		restart = append(restart, fmt.Sprintf("admin_addr %s -> %s", c.AdminAddr, next.AdminAddr))
+		next.AdminAddr = c.AdminAddr
+	}
+	if c.AdminToken != next.AdminToken {
+		live = append(live, "admin_token changed")
+	}
+	if c.Reflection != next.Reflection {
+		restart = append(restart, fmt.Sprintf("reflection %t -> %t", c.Reflection, next.Reflection))
+		next.Reflection = c.Reflection
+	}
+	if c.UnhealthyAfter != next.UnhealthyAfter {
+		live = append(live, fmt.Sprintf("unhealthy_after %d -> %d", c.UnhealthyAfter, next.UnhealthyAfter))
+	}
+	if c.MaxReplays != next.MaxReplays {
+		live = append(live, fmt.Sprintf("max_replays %d -> %d", c.MaxReplays, next.MaxReplays))
+	}
+	if c.ReplayRate != next.ReplayRate {
+		live = append(live, fmt.Sprintf("replay_rate %v -> %v", c.ReplayRate, next.ReplayRate))
+	}
+	if c.TraceExporter != next.TraceExporter {
+		restart = append(restart, fmt.Sprintf("trace_exporter %s -> %s", c.TraceExporter, next.TraceExporter))
+		next.TraceExporter = c.TraceExporter
+	}
+	if c.LogFormat != next.LogFormat {
+		restart = append(restart, fmt.Sprintf("log_format %s -> %s", c.LogFormat, next.LogFormat))
+		next.LogFormat = c.LogFormat
+	}
+	if c.LogLevel != next.LogLevel {
+		live = append(live, fmt.Sprintf("log_level %s -> %s", c.LogLevel, next.LogLevel))
+	}
+	if c.Upstream != next.Upstream {
+		live = append(live, fmt.Sprintf("upstream %s (%s) -> %s (%s)", c.UpstreamEnv, c.Upstream.BaseURL, next.UpstreamEnv, next.Upstream.BaseURL))
+	}
+	if c.AccessSecret != next.AccessSecret {
+		live = append(live, "access_secret changed")
+	}
+	if c.JWT != next.JWT {
+		live = append(live, fmt.Sprintf("jwt %+v -> %+v", c.JWT, next.JWT))
+	} else if c.Signer != nil && next.Signer != nil && c.Signer.kid != next.Signer.kid {
+		live = append(live, fmt.Sprintf("jwt signing key %s -> %s", c.Signer.kid, next.Signer.kid))
+	}
+	if fmt.Sprintf("%+v", c.Clients) != fmt.Sprintf("%+v", next.Clients) {
+		live = append(live, "clients changed")
+	}
+	if tenantIDs(c) != tenantIDs(next) {
+		restart = append(restart, fmt.Sprintf("tenants %s -> %s", tenantIDs(c), tenantIDs(next)))
+		next.Tenants, next.APIKey = c.Tenants, c.APIKey
+	}
+	for _, t := range next.tenants() {
+		if old, ok := c.tenant(t.ID); ok && old.APIKey != t.APIKey {
+			live = append(live, fmt.Sprintf("tenant %s api_key changed", t.ID))
+		}
+	}
+	if c.PolicyFile != next.PolicyFile || fmt.Sprintf("%+v", c.Policy) != fmt.Sprintf("%+v", next.Policy) {
+		live = append(live, fmt.Sprintf("policy %s reloaded", next.PolicyFile))
+	}
+	if fmt.Sprint(c.Filter) != fmt.Sprint(next.Filter) {
+		live = append(live, fmt.Sprintf("filter %+v -> %+v", c.Filter, next.Filter))
+	}
+	return live, restart
+}
+
+func tenantIDs(c *Config) string {
+	var ids []string
+	for _, t := range c.tenants() {
+		ids = append(ids, t.ID)
+	}
+	return "[" + strings.Join(ids, " ") + "]"
+}
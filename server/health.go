@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// pubsubService is the health service name of the Pubsub service. Each
+// tenant's poller is also reported on its own, as "pb_pubsub.Pubsub/<tenant>".
+const pubsubService = "pb_pubsub.Pubsub"
+
+// upstreamAuthError is the upstream refusing a tenant's credentials. Polling
+// again will not help until the credentials are fixed.
+type upstreamAuthError struct {
+	endpoint string
+	status   string
+}
+
+func (e *upstreamAuthError) Error() string {
+	return fmt.Sprintf("%s returned %s", e.endpoint, e.status)
+}
+
+// healthReporter serves grpc.health.v1 with the state of the tenants'
+// pollers. A tenant is NOT_SERVING while its poller is failing: its upstream
+// refused its credentials, or its last polls all failed. The server and
+// Pubsub are only NOT_SERVING when every tenant is, so one organization's
+// revoked key does not take the server out of rotation for the others.
+type healthReporter struct {
+	*health.Server
+
+	mu      sync.Mutex
+	tenants int
+	failing map[string]string // tenant -> why
+}
+
+// newHealthReporter reports every tenant serving until its poller says
+// otherwise, so a new server is not held out of rotation for a poll interval.
+func newHealthReporter(tenants map[string]*tenant) *healthReporter {
+	h := &healthReporter{Server: health.NewServer(), tenants: len(tenants), failing: make(map[string]string)}
+	for id := range tenants {
+		h.SetServingStatus(pubsubService+"/"+id, healthpb.HealthCheckResponse_SERVING)
+	}
+	h.SetServingStatus(pubsubService, healthpb.HealthCheckResponse_SERVING)
+	return h
+}
+
+// pollSucceeded marks tenant serving again.
+func (h *healthReporter) pollSucceeded(tenant string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.failing[tenant]; !ok {
+		return
+	}
+	delete(h.failing, tenant)
+	logger.Info().Str("tenant", tenant).Msg("Poller recovered, serving")
+	h.SetServingStatus(pubsubService+"/"+tenant, healthpb.HealthCheckResponse_SERVING)
+	h.update()
+}
+
+// pollFailed marks tenant not serving if the upstream refused its
+// credentials or it has failed threshold polls in a row.
+func (h *healthReporter) pollFailed(tenant string, failures, threshold int, err error) {
+	var authErr *upstreamAuthError
+	var why string
+	switch {
+	case errors.As(err, &authErr):
+		why = "upstream refused credentials: " + authErr.Error()
+	case failures >= threshold:
+		why = fmt.Sprintf("%d polls failed in a row, last: %v", failures, err)
+	default:
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.failing[tenant]; !ok {
+		logger.Warn().Str("tenant", tenant).Str("reason", why).Msg("Poller failing, not serving")
+	}
+	h.failing[tenant] = why
+	h.SetServingStatus(pubsubService+"/"+tenant, healthpb.HealthCheckResponse_NOT_SERVING)
+	h.update()
+}
+
+// reason is why tenant is not serving, or "" if it is.
+func (h *healthReporter) reason(tenant string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failing[tenant]
+}
+
+// update sets the overall status from the tenants'. h.mu is held.
+func (h *healthReporter) update() {
+	status := healthpb.HealthCheckResponse_SERVING
+	if len(h.failing) >= h.tenants {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	h.SetServingStatus("", status)
+	h.SetServingStatus(pubsubService, status)
+}
+
+// publicMethod reports whether a method is served without a token: health
+// checks, for load balancers and probes, and reflection.
+func publicMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/grpc.health.v1.Health/") ||
+		strings.HasPrefix(fullMethod, "/grpc.reflection.v1alpha.ServerReflection/")
+}
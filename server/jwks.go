@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwksMinRefresh limits how often an unknown kid can trigger a refresh, so
+// tokens with made up key ids cannot hammer the JWKS endpoint.
+const jwksMinRefresh = 30 * time.Second
+
+// keySet holds the public keys tokens are verified with, by key id. It is
+// refreshed from the JWKS file or URL in the current config periodically and
+// whenever a token names a key it does not know, so a newly rotated key is
+// accepted at once while the old one stays valid until it leaves the set.
+type keySet struct {
+	server *pubSubServer
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+	// refreshing is closed when the refresh for an unknown kid in flight is
+	// done. Tokens arriving meanwhile wait for it rather than start another.
+	refreshing chan struct{}
+}
+
+// jwk is one JSON Web Key. Only the members used by RSA and EC public keys are
+// read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// refresh loads the key set again. Without a JWKS source it empties the set.
+func (k *keySet) refresh(ctx context.Context) error {
+	cfg := k.server.config().JWT
+	var data []byte
+	var err error
+	switch {
+	case cfg.JWKSFile != "":
+		data, err = ioutil.ReadFile(cfg.JWKSFile)
+	case cfg.JWKSURL != "":
+		data, err = fetchJWKS(ctx, cfg.JWKSURL)
+	}
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]interface{})
+	if data != nil {
+		if keys, err = parseJWKS(data); err != nil {
+			return err
+		}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.fetched = keys, time.Now()
+	return nil
+}
+
+// run refreshes the key set on the configured interval until ctx is done.
+func (k *keySet) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(k.server.config().JWT.JWKSRefresh.Duration):
+		}
+		if err := k.refresh(ctx); err != nil && ctx.Err() == nil {
+			logger.Warn().Err(err).Msg("Refreshing JWKS, keeping the current keys")
+		}
+	}
+}
+
+// key returns the key with id kid. A token without a kid may only be used
+// while the set holds a single key.
+func (k *keySet) key(ctx context.Context, kid string) (interface{}, error) {
+	k.mu.Lock()
+	key, ok := k.lookup(kid)
+	if ok {
+		k.mu.Unlock()
+		return key, nil
+	}
+	//The refresh is claimed under the lock, so concurrent tokens share one
+	wait, refresh := k.refreshing, false
+	if wait == nil && time.Since(k.fetched) > jwksMinRefresh {
+		wait, refresh = make(chan struct{}), true
+		k.refreshing, k.fetched = wait, time.Now()
+	}
+	k.mu.Unlock()
+
+	if refresh {
+		if err := k.refresh(ctx); err != nil {
+			loggerFrom(ctx).Warn().Err(err).Str("kid", kid).Msg("Refreshing JWKS for an unknown key")
+		}
+		k.mu.Lock()
+		k.refreshing = nil
+		k.mu.Unlock()
+		close(wait)
+	} else if wait != nil {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if wait != nil {
+		k.mu.Lock()
+		key, ok = k.lookup(kid)
+		k.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	if kid == "" {
+		return nil, errors.New("token has no kid")
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (k *keySet) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func fetchJWKS(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parseJWKS reads the signing keys of a JWK set. Keys for other uses or of
+// unsupported types are skipped.
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %v", err)
+	}
+	keys := make(map[string]interface{})
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %d (%q): %v", i, k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %v", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %v", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %v", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("missing")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// asymmetricMethods are the algorithms accepted for tokens verified with the
+// key set.
+var asymmetricMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// verifyToken checks a token's signature, with the signing key or the key set
+// when either is configured or with the shared secret otherwise, and then its
+// expiry, audience and issuer.
+func (s *pubSubServer) verifyToken(ctx context.Context, raw string) (jwt.MapClaims, error) {
+	cfg := s.config()
+	var token *jwt.Token
+	var err error
+	if cfg.JWT.asymmetric() {
+		methods := asymmetricMethods
+		if cfg.AccessSecret != "" {
+			methods = append(methods[:len(methods):len(methods)], "HS256")
+		}
+		parser := &jwt.Parser{ValidMethods: methods}
+		token, err = parser.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+				return []byte(cfg.AccessSecret), nil
+			}
+			kid, _ := token.Header["kid"].(string)
+			if cfg.Signer != nil && kid == cfg.Signer.kid {
+				return cfg.Signer.key.Public(), nil
+			}
+			key, err := s.keys.key(ctx, kid)
+			if err != nil {
+				return nil, err
+			}
+			//Never verify with a key of another type than the token claims to be signed with
+			switch key.(type) {
+			case *rsa.PublicKey:
+				if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+					return nil, fmt.Errorf("key %q is RSA but the token is %v", kid, token.Header["alg"])
+				}
+			case *ecdsa.PublicKey:
+				if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+					return nil, fmt.Errorf("key %q is ECDSA but the token is %v", kid, token.Header["alg"])
+				}
+			}
+			return key, nil
+		})
+	} else {
+		token, err = VerifyToken(raw, cfg.AccessSecret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	if cfg.JWT.asymmetric() && !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("token has no exp or has expired")
+	}
+	if cfg.JWT.Issuer != "" && !claims.VerifyIssuer(cfg.JWT.Issuer, true) {
+		return nil, fmt.Errorf("token is not issued by %s", cfg.JWT.Issuer)
+	}
+	if cfg.JWT.Audience != "" && !hasAudience(claims["aud"], cfg.JWT.Audience) {
+		return nil, fmt.Errorf("token is not for audience %s", cfg.JWT.Audience)
+	}
+	return claims, nil
+}
+
+// hasAudience reads aud as a string or a list of strings.
+func hasAudience(aud interface{}, want string) bool {
+	for _, a := range claimStrings(aud) {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
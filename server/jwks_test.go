@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwksServer serves a JWK set that can be changed between requests, and
+// counts the requests.
+type jwksServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetches int
+	// delay holds every response, so concurrent verifications overlap.
+	delay time.Duration
+}
+
+func newJWKSServer(t *testing.T, keys map[string]interface{}) *jwksServer {
+	j := &jwksServer{keys: keys}
+	j.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.fetches++
+		time.Sleep(j.delay)
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range j.keys {
+			set.Keys = append(set.Keys, toJWK(kid, key))
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(j.Close)
+	return j
+}
+
+func (j *jwksServer) set(keys map[string]interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = keys
+}
+
+func (j *jwksServer) count() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.fetches
+}
+
+func toJWK(kid string, key interface{}) jwk {
+	enc := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: kid, Use: "sig", N: enc(key.N), E: enc(big.NewInt(int64(key.E)))}
+	case *ecdsa.PublicKey:
+		return jwk{Kty: "EC", Kid: kid, Use: "sig", Crv: key.Curve.Params().Name, X: enc(key.X), Y: enc(key.Y)}
+	}
+	panic("unsupported key")
+}
+
+// newTestServer returns a server verifying tokens with the key set of jwks
+// and the JWT settings of cfg.
+func newTestServer(t *testing.T, jwks *jwksServer, cfg Config) *pubSubServer {
+	t.Helper()
+	cfg.JWT.JWKSURL = jwks.URL
+	s := &pubSubServer{}
+	s.keys = &keySet{server: s}
+	s.cfg.Store(&cfg)
+	if err := s.keys.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": "c1", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+var (
+	rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+func TestVerifyTokenKeyType(t *testing.T) {
+	jwks := newJWKSServer(t, map[string]interface{}{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey})
+	s := newTestServer(t, jwks, Config{})
+
+	tests := []struct {
+		name    string
+		method  jwt.SigningMethod
+		kid     string
+		key     interface{}
+		wantErr string
+	}{
+		{"RS256 with RSA key", jwt.SigningMethodRS256, "rsa", rsaKey, ""},
+		{"ES256 with EC key", jwt.SigningMethodES256, "ec", ecKey, ""},
+		{"RS256 naming EC key", jwt.SigningMethodRS256, "ec", rsaKey, `key "ec" is ECDSA but the token is RS256`},
+		{"ES256 naming RSA key", jwt.SigningMethodES256, "rsa", ecKey, `key "rsa" is RSA but the token is ES256`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.verifyToken(context.Background(), sign(t, tt.method, tt.kid, tt.key, validClaims()))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyToken: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verifyToken error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenHS256(t *testing.T) {
+	jwks := newJWKSServer(t, map[string]interface{}{"rsa": &rsaKey.PublicKey})
+	hs := sign(t, jwt.SigningMethodHS256, "", []byte("secret"), validClaims())
+
+	s := newTestServer(t, jwks, Config{})
+	if _, err := s.verifyToken(context.Background(), hs); err == nil {
+		t.Error("HS256 token accepted without an access secret")
+	}
+	//Signed with the public key as an HMAC secret, the classic alg confusion
+	pub, _ := json.Marshal(toJWK("rsa", &rsaKey.PublicKey))
+	if _, err := s.verifyToken(context.Background(), sign(t, jwt.SigningMethodHS256, "rsa", pub, validClaims())); err == nil {
+		t.Error("HS256 token naming an RSA key accepted")
+	}
+
+	s = newTestServer(t, jwks, Config{AccessSecret: "secret"})
+	if _, err := s.verifyToken(context.Background(), hs); err != nil {
+		t.Errorf("HS256 token with the access secret: %v", err)
+	}
+}
+
+func TestVerifyTokenUnknownKid(t *testing.T) {
+	jwks := newJWKSServer(t, map[string]interface{}{"old": &rsaKey.PublicKey})
+	s := newTestServer(t, jwks, Config{})
+	if n := jwks.count(); n != 1 {
+		t.Fatalf("fetched the key set %d times, want 1", n)
+	}
+
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks.set(map[string]interface{}{"old": &rsaKey.PublicKey, "new": &rotated.PublicKey})
+	raw := sign(t, jwt.SigningMethodRS256, "new", rotated, validClaims())
+
+	//Just fetched: an unknown kid must not fetch again
+	if _, err := s.verifyToken(context.Background(), raw); err == nil || !strings.Contains(err.Error(), `unknown key "new"`) {
+		t.Fatalf("verifyToken error = %v, want unknown key", err)
+	}
+	if n := jwks.count(); n != 1 {
+		t.Fatalf("fetched the key set %d times within jwksMinRefresh, want 1", n)
+	}
+
+	s.keys.mu.Lock()
+	s.keys.fetched = time.Now().Add(-jwksMinRefresh - time.Second)
+	s.keys.mu.Unlock()
+	if _, err := s.verifyToken(context.Background(), raw); err != nil {
+		t.Fatalf("verifyToken with a rotated key: %v", err)
+	}
+	if n := jwks.count(); n != 2 {
+		t.Fatalf("fetched the key set %d times, want 2", n)
+	}
+
+	//Made up kids right after do not fetch again either
+	for i := 0; i < 5; i++ {
+		s.verifyToken(context.Background(), sign(t, jwt.SigningMethodRS256, "made-up", rotated, validClaims()))
+	}
+	if n := jwks.count(); n != 2 {
+		t.Fatalf("fetched the key set %d times for made up kids, want 2", n)
+	}
+}
+
+func TestVerifyTokenNoKid(t *testing.T) {
+	jwks := newJWKSServer(t, map[string]interface{}{"only": &rsaKey.PublicKey})
+	s := newTestServer(t, jwks, Config{})
+	raw := sign(t, jwt.SigningMethodRS256, "", rsaKey, validClaims())
+	if _, err := s.verifyToken(context.Background(), raw); err != nil {
+		t.Fatalf("token without kid and a single key: %v", err)
+	}
+
+	jwks.set(map[string]interface{}{"only": &rsaKey.PublicKey, "ec": &ecKey.PublicKey})
+	if err := s.keys.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.verifyToken(context.Background(), raw); err == nil || !strings.Contains(err.Error(), "token has no kid") {
+		t.Fatalf("verifyToken error = %v, want token has no kid", err)
+	}
+}
+
+func TestVerifyTokenClaims(t *testing.T) {
+	jwks := newJWKSServer(t, map[string]interface{}{"rsa": &rsaKey.PublicKey})
+	s := newTestServer(t, jwks, Config{JWT: JWTConfig{Audience: "pubsub", Issuer: "https://issuer"}})
+
+	with := func(set jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{"sub": "c1", "aud": "pubsub", "iss": "https://issuer", "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range set {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		wantErr string
+	}{
+		{"valid", with(nil), ""},
+		{"aud list", with(jwt.MapClaims{"aud": []string{"other", "pubsub"}}), ""},
+		{"wrong aud", with(jwt.MapClaims{"aud": "other"}), "not for audience pubsub"},
+		{"aud list without it", with(jwt.MapClaims{"aud": []string{"other"}}), "not for audience pubsub"},
+		{"no aud", with(jwt.MapClaims{"aud": nil}), "not for audience pubsub"},
+		{"wrong iss", with(jwt.MapClaims{"iss": "https://other"}), "not issued by https://issuer"},
+		{"no iss", with(jwt.MapClaims{"iss": nil}), "not issued by https://issuer"},
+		{"no exp", with(jwt.MapClaims{"exp": nil}), "no exp or has expired"},
+		{"expired", with(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}), "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := s.verifyToken(context.Background(), sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, tt.claims))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyToken: %v", err)
+				}
+				if claims["sub"] != "c1" {
+					t.Fatalf("sub = %v, want c1", claims["sub"])
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verifyToken error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenUnknownKidConcurrent(t *testing.T) {
+	jwks := newJWKSServer(t, map[string]interface{}{"old": &rsaKey.PublicKey})
+	s := newTestServer(t, jwks, Config{})
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks.set(map[string]interface{}{"old": &rsaKey.PublicKey, "new": &rotated.PublicKey})
+	jwks.mu.Lock()
+	jwks.delay = 100 * time.Millisecond
+	jwks.mu.Unlock()
+	s.keys.mu.Lock()
+	s.keys.fetched = time.Now().Add(-jwksMinRefresh - time.Second)
+	s.keys.mu.Unlock()
+
+	tests := []struct {
+		name string
+		kid  string
+		ok   bool
+	}{
+		{"rotated key", "new", true},
+		{"made up kid", "made-up", false},
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		tt := tests[i%len(tests)]
+		raw := sign(t, jwt.SigningMethodRS256, tt.kid, rotated, validClaims())
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = s.verifyToken(context.Background(), raw)
+		}(i)
+	}
+	wg.Wait()
+
+	//Every token waited for the one refresh
+	for i, err := range errs {
+		if tt := tests[i%len(tests)]; (err == nil) != tt.ok {
+			t.Errorf("%s: verifyToken error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+	if n := jwks.count(); n != 2 {
+		t.Fatalf("fetched the key set %d times for %d concurrent tokens, want 2", n, len(errs))
+	}
+}
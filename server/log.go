@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"github.com/ransdepm/go-grpc-test/logging"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+)
+
+// logger writes the server's structured logs. It logs JSON from the start so
+// even a bad config is reported in a form the log pipeline can read, and is
+// replaced once the config has been loaded.
+var logger = logging.New("grpc-server", logging.FormatJSON)
+
+// setLogLevel changes the level at runtime. name has been validated.
+func setLogLevel(name string) {
+	logging.SetLevel(name)
+}
+
+// loggerFrom returns the logger of the call ctx belongs to, with its fields,
+// or the server's logger outside of a call.
+func loggerFrom(ctx context.Context) *zerolog.Logger {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return &logger
+}
+
+// addLogFields adds fields to the logger of the call ctx belongs to.
+func addLogFields(ctx context.Context, fields func(zerolog.Context) zerolog.Context) {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		l.UpdateContext(fields)
+	}
+}
+
+// peerAddr is the address a call came from.
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return "unknown"
+}
+
+// logStreamInterceptor gives every stream a logger with the peer, method and
+// trace of the call, and logs how the stream ended. It runs before
+// authentication so refused calls are logged too.
+func logStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, l := callLogger(stream.Context(), info.FullMethod)
+	wrapped := grpc_middleware.WrapServerStream(stream)
+	wrapped.WrappedContext = ctx
+	start := time.Now()
+	err := handler(srv, wrapped)
+	logCall(l, info.FullMethod, err, start, "Stream ended")
+	return err
+}
+
+// logUnaryInterceptor does the same for unary calls.
+func logUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, l := callLogger(ctx, info.FullMethod)
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logCall(l, info.FullMethod, err, start, "Call finished")
+	return resp, err
+}
+
+func callLogger(ctx context.Context, method string) (context.Context, *zerolog.Logger) {
+	c := logger.With().Str("peer", peerAddr(ctx)).Str("method", method)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		c = c.Str("trace_id", sc.TraceID().String())
+	}
+	l := c.Logger()
+	return l.WithContext(ctx), &l
+}
+
+// logCall logs the end of a call, as a warning unless it succeeded or the
+// caller went away. Health checks and reflection are only logged at debug
+// level, as probes make them every few seconds.
+func logCall(l *zerolog.Logger, method string, err error, start time.Time, msg string) {
+	code := grpcCode(err)
+	event := l.Info()
+	if publicMethod(method) {
+		event = l.Debug()
+	}
+	if code != codes.OK && code != codes.Canceled {
+		event = l.Warn().Err(err)
+	}
+	event.Str("grpc_code", code.String()).Dur("duration_ms", time.Since(start)).Msg(msg)
+}
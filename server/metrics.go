@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"github.com/ransdepm/go-grpc-test/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC metrics, named like those of go-grpc-prometheus so existing
+// dashboards work.
+var (
+	grpcStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_started_total",
+		Help: "RPCs started on the server.",
+	}, []string{"grpc_type", "grpc_service", "grpc_method"})
+	grpcHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "RPCs completed on the server, by status code.",
+	}, []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"})
+	grpcHandling = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Help:    "How long RPCs took until the server finished them. Streams last as long as the subscription.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 60, 300, 1800, 3600},
+	}, []string{"grpc_type", "grpc_service", "grpc_method"})
+)
+
+// Subscription and polling metrics.
+var (
+	activeStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pubsub_active_streams",
+		Help: "Open subscriptions.",
+	}, []string{"tenant", "topic"})
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pubsub_upstream_request_duration_seconds",
+		Help:    "Upstream API requests, by endpoint and HTTP status code, or error if there was no response.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "code"})
+	polls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_polls_total",
+		Help: "Upstream polls, by result.",
+	}, []string{"tenant", "result"})
+	pollOrders = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pubsub_poll_orders",
+		Help:    "Orders received per successful poll.",
+		Buckets: []float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	}, []string{"tenant"})
+	dedupeHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_dedupe_hits_total",
+		Help: "Orders not sent again: repeated by the next poll, or already held by a resuming subscriber.",
+	}, []string{"tenant", "source"})
+	ordersSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_orders_sent_total",
+		Help: "Orders sent to subscribers.",
+	}, []string{"tenant"})
+	sendFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_send_failures_total",
+		Help: "Orders that could not be sent because the stream broke.",
+	}, []string{"tenant"})
+	subscribersDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_subscribers_dropped_total",
+		Help: "Subscribers disconnected for falling too far behind.",
+	}, []string{"tenant"})
+	sendLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pubsub_send_lag_seconds",
+		Help:    "Time from an order's creation to it being sent to a subscriber.",
+		Buckets: []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300, 600, 1800},
+	}, []string{"tenant"})
+	subscriberLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pubsub_subscriber_send_lag_seconds",
+		Help: "Time from creation to sending of the last order sent on each open subscription, by its admin API id.",
+	}, []string{"tenant", "subscription"})
+	activeReplays = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pubsub_active_replays",
+		Help: "Running replays.",
+	}, []string{"tenant"})
+	ordersReplayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_orders_replayed_total",
+		Help: "Orders sent by replays. They are not counted in pubsub_orders_sent_total.",
+	}, []string{"tenant"})
+)
+
+// serveMetrics serves the metrics at http://<addr>/metrics until ctx is done.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logger.Info().Str("addr", addr).Msg("Serving metrics at /metrics")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error().Err(err).Msg("Serving metrics")
+	}
+}
+
+// metricsStreamInterceptor counts streams and how long they lasted. It runs
+// before authentication so rejected calls are counted too.
+func metricsStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	typ := "bidi_stream"
+	switch {
+	case info.IsServerStream && !info.IsClientStream:
+		typ = "server_stream"
+	case info.IsClientStream && !info.IsServerStream:
+		typ = "client_stream"
+	}
+	service, method := splitMethod(info.FullMethod)
+	start := time.Now()
+	grpcStarted.WithLabelValues(typ, service, method).Inc()
+	err := handler(srv, stream)
+	grpcHandled.WithLabelValues(typ, service, method, grpcCode(err).String()).Inc()
+	grpcHandling.WithLabelValues(typ, service, method).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// metricsUnaryInterceptor counts unary calls and how long they took.
+func metricsUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	service, method := splitMethod(info.FullMethod)
+	start := time.Now()
+	grpcStarted.WithLabelValues("unary", service, method).Inc()
+	resp, err := handler(ctx, req)
+	grpcHandled.WithLabelValues("unary", service, method, grpcCode(err).String()).Inc()
+	grpcHandling.WithLabelValues("unary", service, method).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// grpcCode is the status code a call ended with. A stream whose subscriber
+// left ends with the context's error, which is reported as Canceled.
+func grpcCode(err error) codes.Code {
+	switch err {
+	case context.Canceled:
+		return codes.Canceled
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	}
+	return status.Code(err)
+}
+
+// splitMethod splits "/package.Service/Method".
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", "unknown"
+}
+
+// upstreamTransport times and traces requests to one upstream endpoint, and
+// passes the trace on to the upstream in the traceparent header.
+type upstreamTransport struct {
+	endpoint string
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), req.Method+" "+t.endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.method", req.Method), attribute.String("http.url", req.URL.Redacted())))
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	}
+	upstreamDuration.WithLabelValues(t.endpoint, code).Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
+	return resp, err
+}
+
+// observeSent records that transaction was sent on subscription, and how long
+// after it was created. It returns that lag, or 0 without a valid timestamp.
+func observeSent(tenant, subscription string, transaction *pb.SubscribeStreamResponse) time.Duration {
+	ordersSent.WithLabelValues(tenant).Inc()
+	created, err := time.Parse(time.RFC3339, transaction.Timestamp)
+	if err != nil {
+		return 0
+	}
+	lag := time.Since(created)
+	sendLag.WithLabelValues(tenant).Observe(lag.Seconds())
+	subscriberLag.WithLabelValues(tenant, subscription).Set(lag.Seconds())
+	return lag
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/ransdepm/go-grpc-test/config"
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+)
+
+// Actions a policy rule can allow. There is no Publish RPC yet; publish rules
+// are accepted so policy files can be written ahead of it.
+const (
+	actionSubscribe = "subscribe"
+	actionPublish   = "publish"
+)
+
+// Policy decides which subscribers may use which topics and which events
+// they see. A call is allowed if any rule matches it; with no matching rule
+// it is denied.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule matches callers by JWT claims and topic. Empty lists match
+// everything. A matching rule can also limit the events the caller sees, to
+// fixed venues and vendors or to those listed in the caller's venue_ids and
+// vendor_ids claims.
+type PolicyRule struct {
+	Name    string   `json:"name"`
+	Roles   []string `json:"roles,omitempty"`   // any of the roles claim
+	Tenants []string `json:"tenants,omitempty"` // the tenant claim
+	Topics  []string `json:"topics,omitempty"`  // path.Match patterns, without the tenant
+	Actions []string `json:"actions,omitempty"` // subscribe or publish
+
+	VenueIDs         []int64 `json:"venue_ids,omitempty"`
+	VendorIDs        []int64 `json:"vendor_ids,omitempty"`
+	VenuesFromClaim  bool    `json:"venues_from_claim,omitempty"`
+	VendorsFromClaim bool    `json:"vendors_from_claim,omitempty"`
+}
+
+// loadPolicy reads and checks a YAML or JSON policy file.
+func loadPolicy(file string) (*Policy, error) {
+	var p Policy
+	if err := config.ReadFile(file, &p); err != nil {
+		return nil, err
+	}
+	if len(p.Rules) == 0 {
+		return nil, fmt.Errorf("%s has no rules, which would deny everyone", file)
+	}
+	for i, r := range p.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("rules[%d]", i)
+		}
+		for _, pattern := range r.Topics {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: rule %s: topic %q: %v", file, name, pattern, err)
+			}
+		}
+		for _, a := range r.Actions {
+			if a != actionSubscribe && a != actionPublish {
+				return nil, fmt.Errorf("%s: rule %s: action must be subscribe or publish, got %q", file, name, a)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Authorize returns the events p may see on topic, or nil if p may not use
+// the topic for action at all. A nil Policy allows everything.
+func (pol *Policy) Authorize(p principal, topic, action string) *eventAccess {
+	if pol == nil {
+		return &eventAccess{all: true}
+	}
+	var access *eventAccess
+	for _, r := range pol.Rules {
+		if !r.matches(p, topic, action) {
+			continue
+		}
+		if access == nil {
+			access = &eventAccess{}
+		}
+		if r.unrestricted() {
+			access.all = true
+		} else {
+			access.grants = append(access.grants, r.grant(p))
+		}
+	}
+	return access
+}
+
+func (r PolicyRule) matches(p principal, topic, action string) bool {
+	if len(r.Roles) > 0 && !anyRole(r.Roles, claimStrings(p.Claims["roles"])) {
+		return false
+	}
+	if !containsString(r.Tenants, p.Tenant) || !containsString(r.Actions, action) {
+		return false
+	}
+	if len(r.Topics) == 0 {
+		return true
+	}
+	for _, pattern := range r.Topics {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PolicyRule) unrestricted() bool {
+	return len(r.VenueIDs) == 0 && len(r.VendorIDs) == 0 && !r.VenuesFromClaim && !r.VendorsFromClaim
+}
+
+// grant is the venues and vendors one rule lets the caller see. A claim
+// restriction with no claim lets nothing through.
+func (r PolicyRule) grant(p principal) Filter {
+	f := Filter{VenueIDs: r.VenueIDs, VendorIDs: r.VendorIDs}
+	if r.VenuesFromClaim {
+		f.VenueIDs = append(append([]int64{}, f.VenueIDs...), claimIDs(p.Claims["venue_ids"])...)
+		if len(f.VenueIDs) == 0 {
+			f.VenueIDs = []int64{-1}
+		}
+	}
+	if r.VendorsFromClaim {
+		f.VendorIDs = append(append([]int64{}, f.VendorIDs...), claimIDs(p.Claims["vendor_ids"])...)
+		if len(f.VendorIDs) == 0 {
+			f.VendorIDs = []int64{-1}
+		}
+	}
+	return f
+}
+
+// eventAccess is the events an authorized caller may see: all of them, or
+// those any one grant matches.
+type eventAccess struct {
+	all    bool
+	grants []Filter
+}
+
+// Allows reports whether the caller may see transaction.
+func (a *eventAccess) Allows(transaction *pb.SubscribeStreamResponse) bool {
+	if a.all {
+		return true
+	}
+	for _, g := range a.grants {
+		if g.Matches(transaction) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyRole(want, have []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimStrings reads a claim that is a string or a list of strings.
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// claimIDs reads a claim that is a number or a list of numbers.
+func claimIDs(v interface{}) []int64 {
+	switch v := v.(type) {
+	case float64:
+		return []int64{int64(v)}
+	case []interface{}:
+		var out []int64
+		for _, item := range v {
+			if n, ok := item.(float64); ok {
+				out = append(out, int64(n))
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+)
+
+// order is an event at venue and vendor.
+func order(venue, vendor int64) *pb.SubscribeStreamResponse {
+	return &pb.SubscribeStreamResponse{Id: "o", Type: "sale", VenueId: venue, VendorId: vendor}
+}
+
+// allowed returns which of events access lets through, by index.
+func allowed(access *eventAccess, events []*pb.SubscribeStreamResponse) []int {
+	var out []int
+	for i, e := range events {
+		if access.Allows(e) {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAuthorizeNilPolicy(t *testing.T) {
+	var pol *Policy
+	access := pol.Authorize(principal{Subject: "anyone"}, "anything", actionPublish)
+	if access == nil || !access.all {
+		t.Fatalf("nil policy access = %+v, want all", access)
+	}
+	if !access.Allows(order(1, 2)) {
+		t.Fatal("nil policy does not allow an event")
+	}
+}
+
+func TestAuthorizeMatching(t *testing.T) {
+	pol := &Policy{Rules: []PolicyRule{
+		{Name: "admins", Roles: []string{"admin"}},
+		{Name: "acme viewers", Roles: []string{"viewer", "auditor"}, Tenants: []string{"acme"}, Topics: []string{"orders"}, Actions: []string{actionSubscribe}},
+		{Name: "reports", Tenants: []string{"globex"}, Topics: []string{"reports/*"}},
+	}}
+	claims := func(roles ...interface{}) jwt.MapClaims { return jwt.MapClaims{"roles": roles} }
+
+	tests := []struct {
+		name   string
+		p      principal
+		topic  string
+		action string
+		want   bool
+	}{
+		{"role in list", principal{Tenant: "other", Claims: claims("admin")}, "anything", actionPublish, true},
+		{"role as a string", principal{Tenant: "other", Claims: jwt.MapClaims{"roles": "admin"}}, "anything", actionPublish, true},
+		{"any of the roles", principal{Tenant: "acme", Claims: claims("guest", "auditor")}, "orders", actionSubscribe, true},
+		{"no roles claim", principal{Tenant: "acme"}, "orders", actionSubscribe, false},
+		{"other tenant", principal{Tenant: "globex", Claims: claims("viewer")}, "orders", actionSubscribe, false},
+		{"other topic", principal{Tenant: "acme", Claims: claims("viewer")}, "reports/daily", actionSubscribe, false},
+		{"other action", principal{Tenant: "acme", Claims: claims("viewer")}, "orders", actionPublish, false},
+		{"topic pattern", principal{Tenant: "globex"}, "reports/daily", actionPublish, true},
+		{"pattern does not cross /", principal{Tenant: "globex"}, "reports/daily/eu", actionSubscribe, false},
+		{"no rule", principal{Tenant: "initech", Claims: claims("viewer")}, "orders", actionSubscribe, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pol.Authorize(tt.p, tt.topic, tt.action) != nil
+			if got != tt.want {
+				t.Fatalf("authorized = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeUnion(t *testing.T) {
+	events := []*pb.SubscribeStreamResponse{order(1, 10), order(2, 20), order(3, 30), order(4, 40)}
+	p := principal{Tenant: "acme", Claims: jwt.MapClaims{"roles": []interface{}{"viewer"}, "venue_ids": []interface{}{float64(3)}}}
+
+	tests := []struct {
+		name  string
+		rules []PolicyRule
+		want  []int
+	}{
+		{"one rule", []PolicyRule{{VenueIDs: []int64{1}}}, []int{0}},
+		{"venues of several rules", []PolicyRule{
+			{VenueIDs: []int64{1}},
+			{Roles: []string{"viewer"}, VenueIDs: []int64{2}},
+			{Roles: []string{"admin"}, VenueIDs: []int64{4}},
+		}, []int{0, 1}},
+		{"fixed venues and the claim", []PolicyRule{
+			{VenueIDs: []int64{1}},
+			{VenuesFromClaim: true},
+		}, []int{0, 2}},
+		{"each rule's venue and vendor together", []PolicyRule{
+			{VenueIDs: []int64{1}, VendorIDs: []int64{20}},
+			{VenueIDs: []int64{2}, VendorIDs: []int64{20}},
+		}, []int{1}},
+		{"an unrestricted rule allows everything", []PolicyRule{
+			{VenueIDs: []int64{1}},
+			{Roles: []string{"viewer"}},
+		}, []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access := (&Policy{Rules: tt.rules}).Authorize(p, "orders", actionSubscribe)
+			if access == nil {
+				t.Fatal("not authorized")
+			}
+			if got := allowed(access, events); !equalInts(got, tt.want) {
+				t.Fatalf("allowed events %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeFromClaim(t *testing.T) {
+	events := []*pb.SubscribeStreamResponse{order(0, 0), order(1, 10), order(2, 20)}
+	pol := &Policy{Rules: []PolicyRule{{VenuesFromClaim: true, VendorsFromClaim: true}}}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   []int
+	}{
+		{"list claims", jwt.MapClaims{"venue_ids": []interface{}{float64(1), float64(2)}, "vendor_ids": []interface{}{float64(10), float64(20)}}, []int{1, 2}},
+		{"number claims", jwt.MapClaims{"venue_ids": float64(2), "vendor_ids": float64(20)}, []int{2}},
+		//Restricted to the claim but without one must see nothing, not everything
+		{"missing claims", jwt.MapClaims{}, nil},
+		{"missing vendor claim", jwt.MapClaims{"venue_ids": []interface{}{float64(1)}}, nil},
+		{"empty claim", jwt.MapClaims{"venue_ids": []interface{}{}, "vendor_ids": []interface{}{float64(10)}}, nil},
+		{"claim of the wrong type", jwt.MapClaims{"venue_ids": "1", "vendor_ids": float64(10)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access := pol.Authorize(principal{Claims: tt.claims}, "orders", actionSubscribe)
+			if access == nil {
+				t.Fatal("not authorized")
+			}
+			if got := allowed(access, events); !equalInts(got, tt.want) {
+				t.Fatalf("allowed events %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrantMissingClaim(t *testing.T) {
+	r := PolicyRule{VenueIDs: []int64{5}, VenuesFromClaim: true, VendorsFromClaim: true}
+	f := r.grant(principal{Claims: jwt.MapClaims{}})
+	//Fixed venues stay; the vendors claim is missing, so no vendor may match
+	if len(f.VenueIDs) != 1 || f.VenueIDs[0] != 5 {
+		t.Errorf("venue ids = %v, want [5]", f.VenueIDs)
+	}
+	if len(f.VendorIDs) != 1 || f.VendorIDs[0] != -1 {
+		t.Errorf("vendor ids = %v, want [-1]", f.VendorIDs)
+	}
+	if r.VenueIDs[0] != 5 || len(r.VenueIDs) != 1 {
+		t.Errorf("grant changed the rule's venue ids to %v", r.VenueIDs)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/ransdepm/go-grpc-test/config"
+)
+
+// reloadDebounce lets an editor finish writing the config file, which is
+// often several events, before it is read.
+const reloadDebounce = 250 * time.Millisecond
+
+// watchConfig reloads the config on SIGHUP and whenever the config file or
+// the current policy file changes, until ctx is done.
+func (s *pubSubServer) watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	configFile := config.File(flag.CommandLine, nil)
+	var (
+		watch  configWatch
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		watch.watcher = watcher
+		events, errs = watcher.Events, watcher.Errors
+		err = watch.watch(configFile, s.config().PolicyFile)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Msg("Not watching the config for changes, reload with SIGHUP instead")
+	}
+	reload := func() {
+		s.reload()
+		//A reload can point at another policy file, which is the one to watch from now on
+		if watch.watcher != nil {
+			if err := watch.watch(configFile, s.config().PolicyFile); err != nil {
+				logger.Warn().Err(err).Msg("Not watching the policy file for changes, reload with SIGHUP instead")
+			}
+		}
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info().Msg("Received SIGHUP, reloading config")
+			reload()
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if watch.files[filepath.Clean(ev.Name)] && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				debounce = time.After(reloadDebounce)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			logger.Warn().Err(err).Msg("Watching config")
+		case <-debounce:
+			logger.Info().Msg("Config or policy file changed, reloading config")
+			reload()
+		}
+	}
+}
+
+// configWatch watches the directories of the config and policy files rather
+// than the files, so replacing a file by renaming over it is seen too.
+type configWatch struct {
+	watcher *fsnotify.Watcher
+	files   map[string]bool
+	dirs    map[string]bool
+}
+
+// watch makes paths the watched files. Directories no other file is in any
+// more are dropped. A file whose directory cannot be watched is left out.
+func (w *configWatch) watch(paths ...string) error {
+	var firstErr error
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		path = filepath.Clean(path)
+		dir := filepath.Dir(path)
+		if !w.dirs[dir] && !dirs[dir] {
+			if err := w.watcher.Add(dir); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+		}
+		dirs[dir] = true
+		if !files[path] && !w.files[path] {
+			logger.Info().Str("path", path).Msg("Watching for changes")
+		}
+		files[path] = true
+	}
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			w.watcher.Remove(dir)
+		}
+	}
+	w.files, w.dirs = files, dirs
+	return firstErr
+}
+
+// reload loads and validates the config again and applies it. An invalid
+// config is ignored and the current one kept. Settings that only take effect
+// on restart keep their current value until then.
+func (s *pubSubServer) reload() {
+	next, err := reloadConfig()
+	if err != nil {
+		logger.Error().Err(err).Msg("Keeping the current config")
+		return
+	}
+	current := s.config()
+	live, restart := current.changes(next)
+	if len(restart) > 0 {
+		logger.Warn().Strs("changes", restart).Msg("Restart the server to apply")
+	}
+	if len(live) == 0 {
+		logger.Info().Msg("Config reloaded, nothing to apply")
+		return
+	}
+	s.cfg.Store(next)
+	setLogLevel(next.LogLevel)
+	s.setReplayRate(next.ReplayRate)
+	logger.Info().Strs("changes", live).Msg("Config reloaded")
+}
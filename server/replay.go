@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/ransdepm/go-grpc-test/logging"
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newReplayLimiter paces every replay together at replayRate orders a second,
+// so a backfill cannot take the upstream or the network from live
+// subscribers.
+func newReplayLimiter(replayRate float64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(replayRate), replayBurst(replayRate))
+}
+
+// setReplayRate changes the pace of running and future replays.
+func (s *pubSubServer) setReplayRate(replayRate float64) {
+	s.replayLimit.SetLimit(rate.Limit(replayRate))
+	s.replayLimit.SetBurst(replayBurst(replayRate))
+}
+
+// replayBurst lets a second's worth of orders through at once.
+func replayBurst(replayRate float64) int {
+	return int(math.Max(1, math.Ceil(replayRate)))
+}
+
+// replayWindow parses the window of a replay. end defaults to now.
+func replayWindow(in *pb.ReplayRequest, now time.Time) (time.Time, time.Time, error) {
+	if in.Start == "" {
+		return time.Time{}, time.Time{}, status.Error(codes.InvalidArgument, "start is required")
+	}
+	start, err := time.Parse(time.RFC3339, in.Start)
+	if err != nil {
+		return time.Time{}, time.Time{}, status.Errorf(codes.InvalidArgument, "start: %v", err)
+	}
+	end := now
+	if in.End != "" {
+		if end, err = time.Parse(time.RFC3339, in.End); err != nil {
+			return time.Time{}, time.Time{}, status.Errorf(codes.InvalidArgument, "end: %v", err)
+		}
+	}
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, status.Errorf(codes.InvalidArgument, "start %s is not before end %s", in.Start, end.UTC().Format(time.RFC3339))
+	}
+	return start, end, nil
+}
+
+// Replay streams the orders the upstream has for a past window, page by page,
+// marked replayed, and ends. Nothing is kept locally, so every replay reads
+// the upstream again. The same filter and policy apply as to Subscribe.
+func (s *pubSubServer) Replay(in *pb.ReplayRequest, stream pb.Pubsub_ReplayServer) error {
+	start, end, err := replayWindow(in, time.Now())
+	if err != nil {
+		return err
+	}
+	p, t, err := s.openTopic(stream.Context(), in.TopicName)
+	if err != nil {
+		return err
+	}
+
+	cfg := s.config()
+	if n := atomic.AddInt32(&s.replays, 1); int(n) > cfg.MaxReplays {
+		atomic.AddInt32(&s.replays, -1)
+		return status.Errorf(codes.ResourceExhausted, "already running the %d replays max_replays allows, try again later", cfg.MaxReplays)
+	}
+	defer atomic.AddInt32(&s.replays, -1)
+	activeReplays.WithLabelValues(t.id).Inc()
+	defer activeReplays.WithLabelValues(t.id).Dec()
+
+	ctx, cancel := s.untilShutdown(stream.Context())
+	defer cancel()
+
+	addLogFields(ctx, func(c zerolog.Context) zerolog.Context { return c.Str("topic", in.TopicName) })
+	l := loggerFrom(ctx)
+	l.Info().Time("start", start).Time("end", end).Msg("Replaying")
+	perOrder := logging.Sampled(*l)
+
+	//A replay cut short tells the caller to run it again. The upstream does not
+	//promise to return orders in time order, so only the start is safe.
+	sent := 0
+	resumeFrom := start.UTC().Format(time.RFC3339)
+	stopped := func(err error) error {
+		if stream.Context().Err() != nil {
+			return stream.Context().Err()
+		}
+		if ctx.Err() != nil {
+			return status.Errorf(codes.Unavailable, "server is shutting down, replay again from %s", resumeFrom)
+		}
+		return status.Errorf(codes.Unavailable, "replay stopped after %d orders, replay again from %s: %v", sent, resumeFrom, err)
+	}
+
+	tc, _ := cfg.tenant(t.id)
+	token, err := getAuth(ctx, cfg.Upstream, tc.APIKey)
+	if err != nil {
+		return stopped(err)
+	}
+
+	//Errors sending a page are final; those of the upstream are reported by stopped
+	var sendErr error
+	pages, err := eachPage(ctx, cfg.Upstream, token, start, end, func(txs []*pb.SubscribeStreamResponse) error {
+		stampTrace(ctx, txs)
+		cfg := s.config()
+		access := cfg.Policy.Authorize(p, ordersTopic, actionSubscribe)
+		if access == nil {
+			sendErr = status.Errorf(codes.PermissionDenied, "no policy lets %s subscribe to %s any more", p.Subject, ordersTopic)
+			return sendErr
+		}
+		for _, transaction := range txs {
+			if !cfg.Filter.Matches(transaction) || !access.Allows(transaction) {
+				continue
+			}
+			if err := s.replayLimit.Wait(ctx); err != nil {
+				sendErr = stopped(err)
+				return sendErr
+			}
+			transaction.Replayed = true
+			if err := stream.Send(transaction); err != nil {
+				sendErr = err
+				return sendErr
+			}
+			sent++
+			ordersReplayed.WithLabelValues(t.id).Inc()
+			perOrder.Debug().Str("event_id", transaction.Id).Str("event_timestamp", transaction.Timestamp).Msg("Replayed order")
+		}
+		return nil
+	})
+	if sendErr != nil {
+		return sendErr
+	}
+	if err != nil {
+		return stopped(err)
+	}
+	l.Info().Int("orders", sent).Int("pages", pages).Msg("Replay finished")
+	return nil
+}
@@ -23,33 +23,87 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
-	"github.com/joho/godotenv"
+	"github.com/golang-jwt/jwt/v4"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/grpclog"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 
+	"github.com/ransdepm/go-grpc-test/logging"
 	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"github.com/ransdepm/go-grpc-test/tracing"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 var (
-	jsonDBFile             = flag.String("json_db_file", "", "A json file containing a list of features")
-	port, errPort          = strconv.Atoi(goDotEnvVariable("PORT"))
-	server_sleep, errSleep = strconv.Atoi(goDotEnvVariable("STREAM_SLEEP"))
+	jsonDBFile = flag.String("json_db_file", "", "A json file containing a list of features")
 )
 
 type pubSubServer struct {
 	pb.UnimplementedPubsubServer
 	saveTransactions []*pb.SubscribeStreamResponse // read-only after initialized
+
+	// tenants are fixed at startup, keyed by id.
+	tenants map[string]*tenant
+	// keys verifies asymmetrically signed tokens.
+	keys *keySet
+	// health reports whether the tenants' pollers are working.
+	health *healthReporter
+	// subscribers numbers subscriptions for the admin API.
+	subscribers uint64
+	// replays counts running replays, and replayLimit paces them.
+	replays     int32
+	replayLimit *rate.Limiter
+
+	// cfg holds the current *Config. It is replaced whole when the config is
+	// reloaded, so read it once per use with config().
+	cfg atomic.Value
+
+	// shutdown is closed when the server starts draining. New subscriptions
+	// are refused and active ones are sent a going away event and ended.
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+// goingAway is the last event a subscriber receives before the server shuts
+// down. Clients should resubscribe, to another instance or after a restart.
+func goingAway() *pb.SubscribeStreamResponse {
+	return &pb.SubscribeStreamResponse{
+		Type:      "control",
+		Action:    "going_away",
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// reauthenticate ends a stream whose token has expired. Clients should
+// resubscribe with a new token.
+func reauthenticate() *pb.SubscribeStreamResponse {
+	return &pb.SubscribeStreamResponse{
+		Type:      "control",
+		Action:    "reauthenticate",
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
 }
 
 type AuthResponse struct {
@@ -67,55 +121,351 @@ type Orders struct {
 	TxTime   string `json:"created_at"`
 }
 
+// config returns the current config.
+func (s *pubSubServer) config() *Config {
+	return s.cfg.Load().(*Config)
+}
+
 func (s *pubSubServer) Subscribe(topic *pb.SubscribeRequest, stream pb.Pubsub_SubscribeServer) error {
-	for true {
-		var token = getAuth()
-		var txs = getOrders(token)
+	var resumeFrom time.Time
+	if topic.ResumeFrom != "" {
+		var err error
+		if resumeFrom, err = time.Parse(time.RFC3339, topic.ResumeFrom); err != nil {
+			return status.Errorf(codes.InvalidArgument, "resume_from: %v", err)
+		}
+	}
+
+	p, t, err := s.openTopic(stream.Context(), topic.TopicName)
+	if err != nil {
+		return err
+	}
+
+	//Cancel in-flight upstream calls as soon as the subscriber leaves or the server shuts down
+	ctx, cancel := s.untilShutdown(stream.Context())
+	defer cancel()
+
+	addLogFields(ctx, func(c zerolog.Context) zerolog.Context { return c.Str("topic", topic.TopicName) })
+	l := loggerFrom(ctx)
+	l.Info().Str("resume_from", topic.ResumeFrom).Str("resume_after_id", topic.ResumeAfterId).Msg("Subscribed")
+	//One line per order is too many to keep at debug level
+	perOrder := logging.Sampled(*l)
+
+	sub, cursor := t.subscribe(atomic.AddUint64(&s.subscribers, 1), p, peerAddr(ctx), topic.TopicName)
+	defer t.unsubscribe(sub)
+	activeStreams.WithLabelValues(t.id, ordersTopic).Inc()
+	defer activeStreams.WithLabelValues(t.id, ordersTopic).Dec()
+	subject := p.Subject
+	if subject == "" {
+		subject = "anonymous"
+	}
+	//The lag gauge is this subscription's alone, so it goes with it
+	subscription := strconv.FormatUint(sub.id, 10)
+	defer subscriberLag.DeleteLabelValues(t.id, subscription)
+
+	send := func(txs []*pb.SubscribeStreamResponse) error {
+		//Check the current policy on every batch so a reloaded policy applies to open streams
+		cfg := s.config()
+		access := cfg.Policy.Authorize(p, ordersTopic, actionSubscribe)
+		if access == nil {
+			return status.Errorf(codes.PermissionDenied, "no policy lets %s subscribe to %s any more", p.Subject, ordersTopic)
+		}
 		for _, transaction := range txs {
-			if err := stream.Send(&transaction); err != nil {
+			//The subscriber already has this one
+			if transaction.Id == topic.ResumeAfterId {
+				dedupeHits.WithLabelValues(t.id, "resume").Inc()
+				continue
+			}
+			if !cfg.Filter.Matches(transaction) || !access.Allows(transaction) {
+				continue
+			}
+			//Each send continues the trace of the poll that produced the order
+			_, span := tracer.Start(tracing.Extract(ctx, transaction.TraceContext), "send order",
+				trace.WithLinks(trace.LinkFromContext(ctx)),
+				trace.WithAttributes(attribute.String("tenant", t.id), attribute.String("subscriber", subject), attribute.String("order.id", transaction.Id)))
+			err := stream.Send(transaction)
+			tracing.End(span, err)
+			if err != nil {
+				sendFailures.WithLabelValues(t.id).Inc()
 				return err
 			}
+			atomic.StoreInt64(&sub.lag, int64(observeSent(t.id, subscription, transaction)))
+			perOrder.Debug().Str("event_id", transaction.Id).Str("event_timestamp", transaction.Timestamp).Msg("Sent order")
+		}
+		return nil
+	}
+
+	//Catch up on what the tenant's poller published before this subscription
+	if !resumeFrom.IsZero() && resumeFrom.Before(cursor) {
+		cfg := s.config()
+		tc, _ := cfg.tenant(t.id)
+		catchUp, span := tracer.Start(ctx, "catch up", trace.WithAttributes(attribute.String("tenant", t.id)))
+		txs, _, err := fetchOrders(catchUp, cfg.Upstream, tc.APIKey, resumeFrom, cursor)
+		stampTrace(catchUp, txs)
+		tracing.End(span, err)
+		if err != nil {
+			if ctx.Err() == nil {
+				return status.Errorf(codes.Unavailable, "catching up from %s: %v", topic.ResumeFrom, err)
+			}
+		} else if err := send(txs); err != nil {
+			return err
 		}
+	}
 
-		time.Sleep(time.Second * time.Duration(server_sleep))
+	var expired <-chan time.Time
+	if !p.Expires.IsZero() {
+		timer := time.NewTimer(time.Until(p.Expires))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case <-s.shutdown:
+			return stream.Send(goingAway())
+		case <-expired:
+			l.Info().Msg("Token expired, asking the subscriber to reauthenticate")
+			return stream.Send(reauthenticate())
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-sub.dropped:
+			return status.Error(codes.ResourceExhausted, "subscriber fell behind, resubscribe to resume")
+		case <-sub.kicked:
+			return status.Error(codes.Aborted, "disconnected by an administrator")
+		case txs := <-sub.batches:
+			if err := send(txs); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// openTopic checks that the caller of a new stream may read topicName, and
+// returns the caller and its tenant. New streams are refused during shutdown.
+func (s *pubSubServer) openTopic(ctx context.Context, topicName string) (principal, *tenant, error) {
+	select {
+	case <-s.shutdown:
+		return principal{}, nil, status.Error(codes.Unavailable, "server is shutting down")
+	default:
+	}
+
+	p := principalFrom(ctx)
+	t, ok := s.tenants[p.Tenant]
+	if !ok {
+		return p, nil, status.Errorf(codes.PermissionDenied, "tenant %q is not served until the server restarts", p.Tenant)
+	}
+	if err := checkTopic(topicName, t.id); err != nil {
+		return p, nil, err
+	}
+	if s.config().Policy.Authorize(p, ordersTopic, actionSubscribe) == nil {
+		return p, nil, status.Errorf(codes.PermissionDenied, "no policy lets %s subscribe to %s", p.Subject, ordersTopic)
+	}
+	return p, t, nil
+}
+
+// untilShutdown returns a context that is also cancelled when the server
+// starts shutting down.
+func (s *pubSubServer) untilShutdown(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-s.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// ordersTopic is the only topic. Each tenant has its own, which subscribers
+// name either plainly or qualified by their tenant as "<tenant>/orders".
+const ordersTopic = "orders"
+
+// checkTopic resolves a subscriber's topic within its tenant's namespace.
+func checkTopic(name, tenantID string) error {
+	if i := strings.Index(name, "/"); i >= 0 {
+		if name[:i] != tenantID {
+			return status.Errorf(codes.PermissionDenied, "topic %q belongs to another tenant", name)
+		}
+		name = name[i+1:]
+	}
+	if name != ordersTopic {
+		return status.Errorf(codes.InvalidArgument, "unknown topic %q, subscribe to %q", name, ordersTopic)
 	}
 	return nil
 }
 
+// Shutdown stops the server from taking new subscriptions and ends the active
+// ones. It is safe to call more than once.
+func (s *pubSubServer) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+}
+
 func main() {
-	flag.Parse()
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		logger.Fatal().Err(err).Msg("Loading config")
 	}
+	logger = logging.New("grpc-server", cfg.LogFormat)
+	setLogLevel(cfg.LogLevel)
+	grpclog.SetLoggerV2(logging.GRPCLogger(logger))
+	flushSpans, err := tracing.Setup("grpc-server", cfg.TraceExporter)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Setting up tracing")
+	}
+	logger.Info().Str("upstream_env", cfg.UpstreamEnv).Str("upstream_url", cfg.Upstream.BaseURL).Msg("Polling the upstream")
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		logger.Fatal().Err(err).Int("port", cfg.Port).Msg("Listening")
+	}
+	server := newServer(cfg)
 	var opts []grpc.ServerOption
+	opts = append(opts, grpc.ChainStreamInterceptor(metricsStreamInterceptor, tracing.StreamServerInterceptor(), logStreamInterceptor, server.authStreamInterceptor))
+	opts = append(opts, grpc.ChainUnaryInterceptor(metricsUnaryInterceptor, tracing.UnaryServerInterceptor(), logUnaryInterceptor))
 	grpcServer := grpc.NewServer(opts...)
-	pb.RegisterPubsubServer(grpcServer, newServer())
-	grpcServer.Serve(lis)
+	pb.RegisterPubsubServer(grpcServer, server)
+	pb.RegisterAuthServer(grpcServer, &authServer{server: server})
+	healthpb.RegisterHealthServer(grpcServer, server.health)
+	if cfg.Reflection {
+		reflection.Register(grpcServer)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go server.watchConfig(ctx)
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(ctx, cfg.MetricsAddr)
+	}
+	if cfg.AdminAddr != "" {
+		go server.serveAdmin(ctx, cfg.AdminAddr)
+	}
+	if cfg.JWT.jwks() {
+		if err := server.keys.refresh(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Loading JWKS")
+		}
+	}
+	//Runs without a JWKS too, so one added by a reload is picked up
+	go server.keys.run(ctx)
+	for _, t := range server.tenants {
+		go t.run(ctx)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- grpcServer.Serve(lis)
+	}()
+
+	select {
+	case err := <-served:
+		logger.Fatal().Err(err).Msg("Serving gRPC")
+	case <-ctx.Done():
+	}
+	stop()
+
+	//Refuse new subscriptions, tell the active ones we are going away, then wait for them to finish
+	timeout := server.config().ShutdownTimeout
+	logger.Info().Dur("timeout_ms", timeout.Duration).Msg("Shutting down, waiting for subscribers to disconnect")
+	server.health.Shutdown()
+	server.Shutdown()
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout.Duration):
+		logger.Warn().Msg("Shutdown timed out, closing remaining streams")
+		grpcServer.Stop()
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := flushSpans(flushCtx); err != nil {
+		logger.Warn().Err(err).Msg("Flushing spans")
+	}
 }
 
-func newServer() *pubSubServer {
-	s := &pubSubServer{}
+func newServer(cfg *Config) *pubSubServer {
+	s := &pubSubServer{tenants: make(map[string]*tenant), shutdown: make(chan struct{})}
+	s.cfg.Store(cfg)
+	s.keys = &keySet{server: s}
+	s.replayLimit = newReplayLimiter(cfg.ReplayRate)
+	//Start polling one interval back, as a single subscriber always did
+	start := time.Now().Add(-cfg.PollInterval.Duration)
+	for _, tc := range cfg.tenants() {
+		s.tenants[tc.ID] = newTenant(tc.ID, s, start)
+	}
+	s.health = newHealthReporter(s.tenants)
 	return s
 }
 
-func getAuth() string {
-	req, err := http.NewRequest("POST", "https://api-gw.latest.sf.appetize-dev.com/auth/transactions", nil)
+// fetchOrders authenticates with the upstream using apiKey and returns the
+// orders created between from and to, from every page, and how many pages
+// there were. The calls are cancelled with ctx.
+func fetchOrders(ctx context.Context, upstream Upstream, apiKey string, from time.Time, to time.Time) ([]*pb.SubscribeStreamResponse, int, error) {
+	token, err := getAuth(ctx, upstream, apiKey)
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, fmt.Errorf("authenticating: %w", err)
 	}
-	req.Header.Set("x-api-key", goDotEnvVariable("X_API_KEY"))
+	var txs []*pb.SubscribeStreamResponse
+	pages, err := eachPage(ctx, upstream, token, from, to, func(page []*pb.SubscribeStreamResponse) error {
+		txs = append(txs, page...)
+		return nil
+	})
+	return txs, pages, err
+}
+
+// eachPage calls fn with each page of the orders created between from and to,
+// in order, until the upstream returns an empty page. An upstream that does
+// not page returns the first page again, which ends it too. It returns how
+// many pages fn was given, and the first error of the upstream or of fn.
+// Every order is marked with from as its window_start.
+func eachPage(ctx context.Context, upstream Upstream, token string, from time.Time, to time.Time, fn func([]*pb.SubscribeStreamResponse) error) (int, error) {
+	window := from.UTC().Format(time.RFC3339)
+	var first string
+	for page := 1; ; page++ {
+		txs, err := getOrders(ctx, upstream, token, from, to, page)
+		if err != nil {
+			return page - 1, fmt.Errorf("page %d: %w", page, err)
+		}
+		if len(txs) == 0 || txs[0].Id == first {
+			return page - 1, nil
+		}
+		first = txs[0].Id
+		for _, transaction := range txs {
+			transaction.WindowStart = window
+		}
+		if err := fn(txs); err != nil {
+			return page, err
+		}
+	}
+}
+
+func getAuth(ctx context.Context, upstream Upstream, apiKey string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", upstream.authURL(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("x-api-key", apiKey)
 
 	// Send req using http Client
-	client := &http.Client{}
+	client := &http.Client{Transport: upstreamTransport{endpoint: "auth"}}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error on response.\n[ERROR] -", err)
+		return "", err
 	}
+	defer resp.Body.Close()
 
 	responseData, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", &upstreamAuthError{endpoint: "auth", status: resp.Status}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("auth returned %s", resp.Status)
 	}
 
 	//responseDump, err := httputil.DumpResponse(resp, false)
@@ -125,37 +475,47 @@ func getAuth() string {
 	//fmt.Println(string(responseDump))
 
 	var responseObject AuthResponse
-	json.Unmarshal(responseData, &responseObject)
+	if err := json.Unmarshal(responseData, &responseObject); err != nil {
+		return "", err
+	}
 	//fmt.Println(responseObject.AuthKey)
-	return responseObject.AuthKey
+	return responseObject.AuthKey, nil
 }
 
-func getOrders(token string) []pb.SubscribeStreamResponse {
+// getOrders returns one page of the orders created between from and to.
+func getOrders(ctx context.Context, upstream Upstream, token string, from time.Time, to time.Time, page int) ([]*pb.SubscribeStreamResponse, error) {
 	var url string
 	var start string
 	var end string
 
-	end = time.Now().UTC().Format(time.RFC3339)
-	start = time.Now().Add(time.Second * time.Duration(-1*server_sleep)).UTC().Format(time.RFC3339)
-	url = "https://api-gw.latest.sf.appetize-dev.com/transactions_api/orders?start_date=" + start + "&end_date=" + end + "&page=1"
+	end = to.UTC().Format(time.RFC3339)
+	start = from.UTC().Format(time.RFC3339)
+	url = upstream.ordersURL() + "?start_date=" + start + "&end_date=" + end + "&page=" + strconv.Itoa(page)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	var bearer = "Bearer " + token
 	req.Header.Add("Authorization", bearer)
 
 	// Send req using http Client
-	client := &http.Client{}
+	client := &http.Client{Transport: upstreamTransport{endpoint: "orders"}}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error on response.\n[ERROR] -", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	responseData, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, &upstreamAuthError{endpoint: "orders", status: resp.Status}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("orders returned %s", resp.Status)
 	}
 
 	//responseDump, err := httputil.DumpResponse(resp, false)
@@ -165,32 +525,35 @@ func getOrders(token string) []pb.SubscribeStreamResponse {
 	//fmt.Println(string(responseDump))
 
 	var responseObject TransactionResponse
-	json.Unmarshal(responseData, &responseObject)
+	if err := json.Unmarshal(responseData, &responseObject); err != nil {
+		return nil, err
+	}
 
-	//if len(responseObject.Orders) > 0 {
-	numOrders := strconv.FormatInt(int64(len(responseObject.Orders)), 10)
-	fmt.Println("--Recieved " + numOrders + " orders between " + start + " and " + end + ".  Passing to client.")
-	//}
+	loggerFrom(ctx).Debug().Int("page", page).Int("orders", len(responseObject.Orders)).Msg("Received orders")
 
-	var txs = make([]pb.SubscribeStreamResponse, len(responseObject.Orders))
+	var txs = make([]*pb.SubscribeStreamResponse, len(responseObject.Orders))
 	for i, s := range responseObject.Orders {
-		txs[i].Id = s.OrderId
-		txs[i].Type = "sale"
-		txs[i].Action = "order"
-		txs[i].Timestamp = s.TxTime
-		txs[i].ResourceUrl = "https://api-gw.latest.sf.appetize-dev.com/transactions_api/orders/" + s.OrderId
+		txs[i] = &pb.SubscribeStreamResponse{
+			Id:        s.OrderId,
+			Type:      "sale",
+			Action:    "order",
+			Timestamp: s.TxTime,
+			VenueId:   int64(s.VenueId),
+			VendorId:  int64(s.VendorId),
+		}
+		txs[i].ResourceUrl = upstream.resourceURL(txs[i])
 	}
-	return txs
+	return txs, nil
 }
 
-func VerifyToken(r string) (*jwt.Token, error) {
+func VerifyToken(r string, secret string) (*jwt.Token, error) {
 	tokenString := r
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		//Make sure that the token method conform to "SigningMethodHMAC"
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(os.Getenv("ACCESS_SECRET")), nil
+		return []byte(secret), nil
 	})
 	if err != nil {
 		return nil, err
@@ -198,8 +561,8 @@ func VerifyToken(r string) (*jwt.Token, error) {
 	return token, nil
 }
 
-func TokenValid(r string) error {
-	token, err := VerifyToken(r)
+func TokenValid(r string, secret string) error {
+	token, err := VerifyToken(r, secret)
 	if err != nil {
 		return err
 	}
@@ -208,17 +571,3 @@ func TokenValid(r string) error {
 	}
 	return nil
 }
-
-// use godot package to load/read the .env file and
-// return the value of the key
-func goDotEnvVariable(key string) string {
-
-	// load .env file
-	err := godotenv.Load(".env")
-
-	if err != nil {
-		log.Fatalf("Error loading .env file")
-	}
-
-	return os.Getenv(key)
-}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"github.com/ransdepm/go-grpc-test/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// subscriberBuffer is how many polls a subscriber may fall behind before it
+// is disconnected. It resumes from its checkpoint when it resubscribes.
+const subscriberBuffer = 16
+
+// tenant polls the upstream with one organization's credentials and fans the
+// orders out to that organization's subscribers. Every tenant has its own
+// poller and subscribers, so no subscriber ever sees another tenant's orders.
+type tenant struct {
+	id     string
+	server *pubSubServer
+
+	mu          sync.Mutex
+	cursor      time.Time // orders created before cursor have been published
+	subscribers map[*subscriber]struct{}
+	// published is the ids of the last poll's orders. The upstream includes
+	// both ends of a window, so an order at the edge comes back in the next.
+	published map[string]bool
+
+	// paused stops the poller from polling on its interval. The cursor stays
+	// put, so the first poll after resuming covers the whole pause, reading
+	// as many pages as it takes.
+	paused bool
+	// failures counts the polls that failed in a row.
+	failures  int
+	lastPoll  time.Time
+	lastError error
+
+	// pollNow asks the poller for a poll right away.
+	pollNow chan struct{}
+}
+
+// subscriber receives each poll's orders in order.
+type subscriber struct {
+	batches chan []*pb.SubscribeStreamResponse
+	// dropped is closed if the subscriber fell too far behind and was removed.
+	dropped chan struct{}
+	// kicked is closed when an administrator disconnects the subscriber.
+	kicked   chan struct{}
+	kickOnce sync.Once
+
+	// Who the subscriber is, for the admin API.
+	id        uint64
+	principal principal
+	peer      string
+	topic     string
+	since     time.Time
+	// lag is how long after its creation the last order was sent, in
+	// nanoseconds. It is updated atomically.
+	lag int64
+}
+
+func newTenant(id string, server *pubSubServer, start time.Time) *tenant {
+	return &tenant{
+		id:          id,
+		server:      server,
+		cursor:      start,
+		subscribers: make(map[*subscriber]struct{}),
+		pollNow:     make(chan struct{}, 1),
+	}
+}
+
+// subscribe registers a subscriber for every poll from now on and returns the
+// cursor, the point in time from which it will see orders.
+func (t *tenant) subscribe(id uint64, p principal, peer, topic string) (*subscriber, time.Time) {
+	sub := &subscriber{
+		batches:   make(chan []*pb.SubscribeStreamResponse, subscriberBuffer),
+		dropped:   make(chan struct{}),
+		kicked:    make(chan struct{}),
+		id:        id,
+		principal: p,
+		peer:      peer,
+		topic:     topic,
+		since:     time.Now(),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subscribers[sub] = struct{}{}
+	return sub, t.cursor
+}
+
+// kick disconnects the subscriber with id, reporting whether there was one.
+func (t *tenant) kick(id uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for sub := range t.subscribers {
+		if sub.id == id {
+			sub.kickOnce.Do(func() { close(sub.kicked) })
+			return true
+		}
+	}
+	return false
+}
+
+// setPaused pauses or resumes polling on the interval.
+func (t *tenant) setPaused(paused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = paused
+}
+
+func (t *tenant) isPaused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
+// triggerPoll asks for a poll right away, paused or not. A request made while
+// one is already waiting is folded into it.
+func (t *tenant) triggerPoll() {
+	select {
+	case t.pollNow <- struct{}{}:
+	default:
+	}
+}
+
+func (t *tenant) unsubscribe(sub *subscriber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.subscribers, sub)
+}
+
+// publish hands a poll's orders, less those the previous poll already
+// published, to every subscriber and moves the cursor to the end of the polled
+// window. A subscriber whose buffer is full is dropped rather than holding up
+// the others.
+func (t *tenant) publish(txs []*pb.SubscribeStreamResponse, end time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cursor = end
+	fresh := txs[:0:0]
+	published := make(map[string]bool, len(txs))
+	for _, transaction := range txs {
+		published[transaction.Id] = true
+		if t.published[transaction.Id] {
+			dedupeHits.WithLabelValues(t.id, "poll").Inc()
+			continue
+		}
+		fresh = append(fresh, transaction)
+	}
+	t.published, txs = published, fresh
+	if len(txs) == 0 {
+		return
+	}
+	for sub := range t.subscribers {
+		select {
+		case sub.batches <- txs:
+		default:
+			logger.Warn().Str("tenant", t.id).Int("polls_behind", subscriberBuffer).Msg("Dropping a subscriber that fell behind")
+			close(sub.dropped)
+			delete(t.subscribers, sub)
+			subscribersDropped.WithLabelValues(t.id).Inc()
+		}
+	}
+}
+
+// run polls the upstream on the configured interval until ctx is done. A
+// failed poll is retried on the next tick with the window widened to now; the
+// cursor only moves once every page of a window has been read.
+func (t *tenant) run(ctx context.Context) {
+	interval := t.server.config().PollInterval.Duration
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if t.isPaused() {
+				continue
+			}
+		case <-t.pollNow:
+		}
+
+		//Pick up a reloaded config on every poll
+		cfg := t.server.config()
+		if cfg.PollInterval.Duration != interval {
+			interval = cfg.PollInterval.Duration
+			ticker.Reset(interval)
+		}
+		tc, ok := cfg.tenant(t.id)
+		if !ok {
+			continue
+		}
+
+		t.poll(ctx, cfg, tc)
+	}
+}
+
+// poll fetches the orders created since the cursor, from every page, and
+// publishes them. Each poll is the root of a trace that the orders carry to
+// subscribers.
+func (t *tenant) poll(ctx context.Context, cfg *Config, tc TenantConfig) {
+	t.mu.Lock()
+	start := t.cursor
+	t.mu.Unlock()
+	end := time.Now()
+
+	ctx, span := tracer.Start(ctx, "poll", trace.WithNewRoot(), trace.WithAttributes(
+		attribute.String("tenant", t.id),
+		attribute.String("window.start", start.UTC().Format(time.RFC3339)),
+		attribute.String("window.end", end.UTC().Format(time.RFC3339))))
+	fields := logger.With().Str("tenant", t.id).
+		Str("window_start", start.UTC().Format(time.RFC3339)).
+		Str("window_end", end.UTC().Format(time.RFC3339))
+	if sc := span.SpanContext(); sc.IsValid() {
+		fields = fields.Str("trace_id", sc.TraceID().String())
+	}
+	l := fields.Logger()
+	ctx = l.WithContext(ctx)
+	txs, pages, err := fetchOrders(ctx, cfg.Upstream, tc.APIKey, start, end)
+	if err != nil {
+		if ctx.Err() == nil {
+			loggerFrom(ctx).Warn().Err(err).Msg("Polling orders")
+			polls.WithLabelValues(t.id, "error").Inc()
+			t.server.health.pollFailed(t.id, t.polled(err), cfg.UnhealthyAfter, err)
+		}
+		tracing.End(span, err)
+		return
+	}
+	span.SetAttributes(attribute.Int("orders", len(txs)), attribute.Int("pages", pages))
+	if pages > 1 {
+		loggerFrom(ctx).Info().Int("orders", len(txs)).Int("pages", pages).Msg("Polled a window of several pages")
+	}
+	stampTrace(ctx, txs)
+	polls.WithLabelValues(t.id, "ok").Inc()
+	t.polled(nil)
+	t.server.health.pollSucceeded(t.id)
+	pollOrders.WithLabelValues(t.id).Observe(float64(len(txs)))
+	t.publish(txs, end)
+	span.End()
+}
+
+// polled records the result of a poll and returns how many have failed in a
+// row.
+func (t *tenant) polled(err error) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastPoll, t.lastError = time.Now(), err
+	if err == nil {
+		t.failures = 0
+	} else {
+		t.failures++
+	}
+	return t.failures
+}
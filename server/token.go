@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ClientConfig is a client that may exchange its id and secret for an access
+// token. The token carries the client's tenant, roles and venue and vendor
+// ids as claims for the policy. The secret is given directly or as the name
+// of an environment variable.
+type ClientConfig struct {
+	ID        string   `json:"id"`
+	Secret    string   `json:"secret,omitempty"`
+	SecretEnv string   `json:"secret_env,omitempty"`
+	Tenant    string   `json:"tenant,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	VenueIDs  []int64  `json:"venue_ids,omitempty"`
+	VendorIDs []int64  `json:"vendor_ids,omitempty"`
+}
+
+// signingKey is the private key the server issues tokens with. Its public
+// half verifies them, under kid, next to the keys of the JWK set.
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+// loadSigningKey reads a PEM encoded RSA or ECDSA private key. Without a kid
+// the key is named after a hash of its public key, so a rotated key gets a new
+// one.
+func loadSigningKey(file, kid string) (*signingKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", file)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	k := &signingKey{kid: kid}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		k.key, k.method = key, jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		k.key = key
+		switch key.Curve.Params().BitSize {
+		case 256:
+			k.method = jwt.SigningMethodES256
+		case 384:
+			k.method = jwt.SigningMethodES384
+		case 521:
+			k.method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("%s: unsupported curve %s", file, key.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("%s: not an RSA or ECDSA private key", file)
+	}
+	if k.kid == "" {
+		der, err := x509.MarshalPKIXPublicKey(k.key.Public())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		sum := sha256.Sum256(der)
+		k.kid = base64.RawURLEncoding.EncodeToString(sum[:12])
+	}
+	return k, nil
+}
+
+// authServer issues access tokens to the clients in the current config.
+type authServer struct {
+	pb.UnimplementedAuthServer
+	server *pubSubServer
+}
+
+// Token checks the client's secret and returns a token for it that expires
+// after the configured lifetime.
+func (a *authServer) Token(ctx context.Context, in *pb.TokenRequest) (*pb.TokenResponse, error) {
+	cfg := a.server.config()
+	client, ok := cfg.client(in.ClientId)
+	if !ok || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(in.ClientSecret)) != 1 {
+		loggerFrom(ctx).Warn().Str("client_id", in.ClientId).Msg("Refused a token: unknown client or wrong secret")
+		return nil, status.Error(codes.Unauthenticated, "unknown client or wrong secret")
+	}
+	roles := client.Roles
+	if len(in.Roles) > 0 {
+		for _, r := range in.Roles {
+			if !anyRole([]string{r}, client.Roles) {
+				return nil, status.Errorf(codes.PermissionDenied, "client %s does not have role %q", client.ID, r)
+			}
+		}
+		roles = in.Roles
+	}
+
+	token, err := cfg.issueToken(client, roles)
+	if err != nil {
+		loggerFrom(ctx).Error().Err(err).Str("client_id", client.ID).Msg("Issuing a token")
+		return nil, status.Error(codes.Internal, "could not issue a token")
+	}
+	loggerFrom(ctx).Debug().Str("client_id", client.ID).Strs("roles", roles).Dur("lifetime_ms", cfg.JWT.TokenLifetime.Duration).Msg("Issued a token")
+	return &pb.TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(cfg.JWT.TokenLifetime.Seconds()),
+	}, nil
+}
+
+// issueToken signs a token for client with the signing key, or with
+// AccessSecret if there is none.
+func (c *Config) issueToken(client ClientConfig, roles []string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub": client.ID,
+		"iat": now.Unix(),
+		"exp": now.Add(c.JWT.TokenLifetime.Duration).Unix(),
+	}
+	if client.Tenant != "" {
+		claims["tenant"] = client.Tenant
+	}
+	if len(roles) > 0 {
+		claims["roles"] = roles
+	}
+	if len(client.VenueIDs) > 0 {
+		claims["venue_ids"] = client.VenueIDs
+	}
+	if len(client.VendorIDs) > 0 {
+		claims["vendor_ids"] = client.VendorIDs
+	}
+	if c.JWT.Issuer != "" {
+		claims["iss"] = c.JWT.Issuer
+	}
+	if c.JWT.Audience != "" {
+		claims["aud"] = c.JWT.Audience
+	}
+
+	switch {
+	case c.Signer != nil:
+		token := jwt.NewWithClaims(c.Signer.method, claims)
+		token.Header["kid"] = c.Signer.kid
+		return token.SignedString(c.Signer.key)
+	case c.AccessSecret != "":
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(c.AccessSecret))
+	}
+	return "", errors.New("no signing key or access_secret")
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+	"github.com/ransdepm/go-grpc-test/tracing"
+	"go.opentelemetry.io/otel"
+)
+
+// tracer starts the server's own spans: polls, upstream requests, catch-ups
+// and sends. RPC spans come from the tracing interceptors.
+var tracer = otel.Tracer("github.com/ransdepm/go-grpc-test/server")
+
+// stampTrace records the span in ctx as the origin of txs, so subscribers and
+// the client's sinks continue its trace.
+func stampTrace(ctx context.Context, txs []*pb.SubscribeStreamResponse) {
+	envelope := tracing.Inject(ctx)
+	if envelope == nil {
+		return
+	}
+	for _, transaction := range txs {
+		transaction.TraceContext = envelope
+	}
+}
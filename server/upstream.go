@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	pb "github.com/ransdepm/go-grpc-test/pubsub"
+)
+
+// Upstream is where the server polls for orders. Paths are appended to
+// BaseURL. ResourceURL is the template for each order's resource_url and may
+// use {base_url}, {order_id}, {venue_id} and {vendor_id}.
+type Upstream struct {
+	BaseURL     string `json:"base_url,omitempty"`
+	AuthPath    string `json:"auth_path,omitempty"`
+	OrdersPath  string `json:"orders_path,omitempty"`
+	ResourceURL string `json:"resource_url,omitempty"`
+}
+
+// upstreamPaths are the same in every environment of the transactions API.
+var upstreamPaths = Upstream{
+	AuthPath:    "/auth/transactions",
+	OrdersPath:  "/transactions_api/orders",
+	ResourceURL: "{base_url}/transactions_api/orders/{order_id}",
+}
+
+// builtinUpstreams are the profiles available without any configuration.
+// staging and prod have no default base URL; give one with upstream_url or
+// under upstreams in the config file.
+var builtinUpstreams = map[string]Upstream{
+	"dev":     upstreamPaths.with(Upstream{BaseURL: "https://api-gw.latest.sf.appetize-dev.com"}),
+	"staging": upstreamPaths,
+	"prod":    upstreamPaths,
+}
+
+// with returns u with every field set in o replacing its own.
+func (u Upstream) with(o Upstream) Upstream {
+	if o.BaseURL != "" {
+		u.BaseURL = o.BaseURL
+	}
+	if o.AuthPath != "" {
+		u.AuthPath = o.AuthPath
+	}
+	if o.OrdersPath != "" {
+		u.OrdersPath = o.OrdersPath
+	}
+	if o.ResourceURL != "" {
+		u.ResourceURL = o.ResourceURL
+	}
+	return u
+}
+
+// resolveUpstream builds the selected profile: the built-in one, if any, then
+// the config file's upstreams entry, then upstream_url.
+func (c *Config) resolveUpstream() (Upstream, error) {
+	builtin, isBuiltin := builtinUpstreams[c.UpstreamEnv]
+	configured, isConfigured := c.Upstreams[c.UpstreamEnv]
+	if !isBuiltin && !isConfigured {
+		return Upstream{}, fmt.Errorf("upstream_env (UPSTREAM_ENV, -upstream_env) %q is not a profile; choose one of %s", c.UpstreamEnv, strings.Join(c.upstreamNames(), ", "))
+	}
+	if !isBuiltin {
+		builtin = upstreamPaths
+	}
+	u := builtin.with(configured).with(Upstream{BaseURL: c.UpstreamURL})
+	u.BaseURL = strings.TrimRight(u.BaseURL, "/")
+
+	if u.BaseURL == "" {
+		return u, fmt.Errorf("upstream profile %s has no base_url; set upstream_url (UPSTREAM_URL, -upstream_url) or upstreams.%s.base_url", c.UpstreamEnv, c.UpstreamEnv)
+	}
+	if parsed, err := url.Parse(u.BaseURL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return u, fmt.Errorf("upstream profile %s: base_url must be an absolute URL, got %q", c.UpstreamEnv, u.BaseURL)
+	}
+	if !strings.HasPrefix(u.AuthPath, "/") {
+		return u, fmt.Errorf("upstream profile %s: auth_path must start with /, got %q", c.UpstreamEnv, u.AuthPath)
+	}
+	if !strings.HasPrefix(u.OrdersPath, "/") {
+		return u, fmt.Errorf("upstream profile %s: orders_path must start with /, got %q", c.UpstreamEnv, u.OrdersPath)
+	}
+	return u, nil
+}
+
+func (c *Config) upstreamNames() []string {
+	var names []string
+	for name := range builtinUpstreams {
+		names = append(names, name)
+	}
+	for name := range c.Upstreams {
+		if _, ok := builtinUpstreams[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (u Upstream) authURL() string   { return u.BaseURL + u.AuthPath }
+func (u Upstream) ordersURL() string { return u.BaseURL + u.OrdersPath }
+
+// resourceURL fills in the ResourceURL template for one order.
+func (u Upstream) resourceURL(transaction *pb.SubscribeStreamResponse) string {
+	return strings.NewReplacer(
+		"{base_url}", u.BaseURL,
+		"{order_id}", transaction.Id,
+		"{venue_id}", strconv.FormatInt(transaction.VenueId, 10),
+		"{vendor_id}", strconv.FormatInt(transaction.VendorId, 10),
+	).Replace(u.ResourceURL)
+}
@@ -0,0 +1,181 @@
+// Package tracing sets up OpenTelemetry for the server and the client and
+// carries trace context between them: in gRPC metadata for calls, and in the
+// trace_context of every event so the client's spans continue the poll that
+// produced it.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Exporters spans can be sent to. With none, spans are not recorded but trace
+// context received from others is still passed on.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+)
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator for service. The returned function flushes buffered spans.
+func Setup(service, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var opts []sdktrace.TracerProviderOption
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	opts = append(opts, sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))))
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// ValidExporter reports whether exporter can be passed to Setup.
+func ValidExporter(exporter string) bool {
+	return exporter == "" || exporter == ExporterNone || exporter == ExporterStdout
+}
+
+// Inject returns the trace context of ctx for an event envelope, or nil if
+// ctx is not being traced.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx continuing the trace in an event envelope.
+func Extract(ctx context.Context, envelope map[string]string) context.Context {
+	if len(envelope) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(envelope))
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// metadataCarrier reads and writes trace context in gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// rpcSpan starts a span named after a call's method, e.g.
+// "pb_pubsub.Pubsub/Subscribe".
+func rpcSpan(ctx context.Context, tracer trace.Tracer, fullMethod string, kind trace.SpanKind) (context.Context, trace.Span) {
+	return tracer.Start(ctx, strings.TrimPrefix(fullMethod, "/"),
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("rpc.method", fullMethod)))
+}
+
+func endRPC(span trace.Span, err error) {
+	span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+	End(span, err)
+}
+
+func serverContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+}
+
+func clientContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// UnaryServerInterceptor continues the caller's trace in a span for the call.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	tracer := otel.Tracer("github.com/ransdepm/go-grpc-test/tracing")
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, span := rpcSpan(serverContext(ctx), tracer, info.FullMethod, trace.SpanKindServer)
+		resp, err := handler(ctx, req)
+		endRPC(span, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor continues the caller's trace in a span that lasts
+// as long as the stream.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	tracer := otel.Tracer("github.com/ransdepm/go-grpc-test/tracing")
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := rpcSpan(serverContext(stream.Context()), tracer, info.FullMethod, trace.SpanKindServer)
+		err := handler(srv, &tracedServerStream{ServerStream: stream, ctx: ctx})
+		endRPC(span, err)
+		return err
+	}
+}
+
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedServerStream) Context() context.Context { return s.ctx }
+
+// UnaryClientInterceptor sends the trace context of ctx with every call.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(clientContext(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor sends the trace context of ctx when a stream is
+// opened.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(clientContext(ctx), desc, cc, method, opts...)
+	}
+}